@@ -0,0 +1,364 @@
+package jujusvg
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	svg "github.com/ajstarks/svgo"
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	defaultAnimationHold       = time.Second
+	defaultAnimationTransition = time.Second
+	captionHeight              = 30
+)
+
+// AnimationOptions holds options for animating between bundles.
+type AnimationOptions struct {
+	// Hold holds how long each bundle is shown before moving on
+	// to the next. If it is not positive, one second is used.
+	Hold time.Duration
+
+	// Transition holds how long it takes to move from one bundle
+	// to the next. If it is not positive, one second is used.
+	Transition time.Duration
+
+	// Labels optionally holds a caption to show for each bundle,
+	// such as the time at which it was captured. If set, it must
+	// hold one entry for each bundle.
+	Labels []string
+
+	// Repeat specifies that the animation should repeat
+	// indefinitely. By default it stops on the last bundle.
+	Repeat bool
+}
+
+// frame holds the state of an application in a single frame of an
+// animation.
+type frame struct {
+	point   image.Point
+	present bool
+}
+
+// timeline holds the timing of an animated canvas. Each frame is held
+// for the hold duration, followed by a transition to the next frame.
+type timeline struct {
+	frames     int
+	hold       time.Duration
+	transition time.Duration
+	labels     []string
+	repeat     bool
+}
+
+// NewAnimationFromBundles returns a new Canvas that animates between the
+// given bundles in order, such as successive snapshots of a model.
+// Applications move between their positions in each bundle, and
+// applications and relations fade in and out as they are added and
+// removed. The iconURL and fetcher arguments are used as for
+// NewFromBundle; the icon for each charm is fetched only once.
+func NewAnimationFromBundles(ctx context.Context, bundles []*charm.BundleData, opts AnimationOptions, iconURL func(context.Context, *charm.URL) (string, error), fetcher IconFetcher) (*Canvas, error) {
+	if len(bundles) == 0 {
+		return nil, errgo.Newf("no bundles to animate")
+	}
+	if len(opts.Labels) > 0 && len(opts.Labels) != len(bundles) {
+		return nil, errgo.Newf("got %d labels for %d bundles", len(opts.Labels), len(bundles))
+	}
+	if fetcher == nil {
+		fetcher = &LinkFetcher{
+			IconURL: iconURL,
+		}
+	}
+	// Fetch the icons for each bundle, skipping any charms whose
+	// icons have already been fetched for an earlier bundle.
+	iconMap := make(map[string][]byte)
+	requested := make(map[string]bool)
+	for _, b := range bundles {
+		remaining := &charm.BundleData{
+			Applications: make(map[string]*charm.ApplicationSpec),
+		}
+		for name, app := range b.Applications {
+			if _, path, err := parseCharm(app.Charm); err == nil {
+				if requested[path] {
+					continue
+				}
+				requested[path] = true
+			}
+			remaining.Applications[name] = app
+		}
+		if len(remaining.Applications) == 0 {
+			continue
+		}
+		icons, err := fetcher.FetchIcons(ctx, remaining)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		for path, icon := range icons {
+			iconMap[path] = icon
+		}
+	}
+
+	t := &timeline{
+		frames:     len(bundles),
+		hold:       opts.Hold,
+		transition: opts.Transition,
+		labels:     opts.Labels,
+		repeat:     opts.Repeat,
+	}
+	if t.hold <= 0 {
+		t.hold = defaultAnimationHold
+	}
+	if t.transition <= 0 {
+		t.transition = defaultAnimationTransition
+	}
+	canvas := &Canvas{
+		timeline: t,
+	}
+	applications := make(map[string]*application)
+	relations := make(map[[2]string]*applicationRelation)
+	var relationOrder [][2]string
+	for i, b := range bundles {
+		frameCanvas, err := NewFromBundle(ctx, b, iconURL, IconMap(iconMap))
+		if err != nil {
+			return nil, errgo.NoteMask(err, fmt.Sprintf("cannot draw bundle %d", i), errgo.Any)
+		}
+		for _, fa := range frameCanvas.applications {
+			a := applications[fa.name]
+			if a == nil {
+				a = &application{
+					name:     fa.name,
+					frames:   make([]frame, len(bundles)),
+					timeline: t,
+				}
+				applications[fa.name] = a
+			}
+			// Later bundles take precedence for the icon.
+			a.charmPath = fa.charmPath
+			a.iconUrl = fa.iconUrl
+			a.iconSrc = fa.iconSrc
+			a.frames[i] = frame{
+				point:   fa.point,
+				present: true,
+			}
+		}
+		for _, fr := range frameCanvas.relations {
+			key := relationKey([]string{fr.endpointA, fr.endpointB})
+			r := relations[key]
+			if r == nil {
+				r = &applicationRelation{
+					name:         fr.name,
+					endpointA:    fr.endpointA,
+					endpointB:    fr.endpointB,
+					applicationA: applications[fr.applicationA.name],
+					applicationB: applications[fr.applicationB.name],
+					present:      make([]bool, len(bundles)),
+				}
+				relations[key] = r
+				relationOrder = append(relationOrder, key)
+			}
+			r.present[i] = true
+		}
+	}
+	names := make([]string, 0, len(applications))
+	for name := range applications {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := applications[name]
+		a.fillFrames()
+		canvas.addApplication(a)
+	}
+	for _, key := range relationOrder {
+		canvas.addRelation(relations[key])
+	}
+	return canvas, nil
+}
+
+// fillFrames positions the application in the frames in which it is not
+// present at its nearest position in an earlier frame, or failing that a
+// later one, so that it fades in and out in place, and sets its static
+// position to that of the first frame in which it is present.
+func (s *application) fillFrames() {
+	first := -1
+	for i, f := range s.frames {
+		if !f.present {
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		for j := i + 1; j < len(s.frames) && !s.frames[j].present; j++ {
+			s.frames[j].point = f.point
+		}
+	}
+	for j := 0; j < first; j++ {
+		s.frames[j].point = s.frames[first].point
+	}
+	s.point = s.frames[first].point
+}
+
+// animate writes the animation of the application's position and
+// visibility.
+func (s *application) animate(canvas *svg.SVG) {
+	t := s.timeline
+	positions := make([]string, len(s.frames))
+	opacities := make([]string, len(s.frames))
+	for i, f := range s.frames {
+		positions[i] = fmt.Sprintf("%d,%d", f.point.X, f.point.Y)
+		opacities[i] = opacity(f.present)
+	}
+	if !allEqual(positions) {
+		fmt.Fprintf(canvas.Writer, "<animateTransform attributeName=\"transform\" type=\"translate\" values=%q %s/>\n", t.values(positions), t.attrs())
+	}
+	t.animate(canvas.Writer, "opacity", opacities)
+}
+
+// animatedUsage draws a relation whose position and visibility are
+// animated.
+func (r *applicationRelation) animatedUsage(canvas *svg.SVG, color string) {
+	t := r.applicationA.timeline
+	n := len(r.present)
+	opacities := make([]string, n)
+	geometries := make([]relationGeometry, n)
+	for i := range r.present {
+		opacities[i] = opacity(r.present[i])
+		geometries[i] = relationGeometryBetween(r.applicationA.frames[i].point, r.applicationB.frames[i].point)
+	}
+	t.animate(canvas.Writer, "opacity", opacities)
+	values := func(f func(g relationGeometry) string) []string {
+		vs := make([]string, n)
+		for i, g := range geometries {
+			vs[i] = f(g)
+		}
+		return vs
+	}
+	g := r.geometry()
+	fmt.Fprintf(canvas.Writer, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=%q stroke-width=\"%dpx\" stroke-dasharray=%q>\n",
+		g.line.p0.X, g.line.p0.Y, g.line.p1.X, g.line.p1.Y, color, relationLineWidth, strokeDashArray(g.line))
+	t.animate(canvas.Writer, "x1", values(func(g relationGeometry) string { return fmt.Sprint(g.line.p0.X) }))
+	t.animate(canvas.Writer, "y1", values(func(g relationGeometry) string { return fmt.Sprint(g.line.p0.Y) }))
+	t.animate(canvas.Writer, "x2", values(func(g relationGeometry) string { return fmt.Sprint(g.line.p1.X) }))
+	t.animate(canvas.Writer, "y2", values(func(g relationGeometry) string { return fmt.Sprint(g.line.p1.Y) }))
+	t.animate(canvas.Writer, "stroke-dasharray", values(func(g relationGeometry) string { return strokeDashArray(g.line) }))
+	io.WriteString(canvas.Writer, "</line>\n")
+
+	fmt.Fprintf(canvas.Writer, "<use x=\"%d\" y=\"%d\" xlink:href=\"#healthCircle\">\n", g.health.X, g.health.Y)
+	t.animate(canvas.Writer, "x", values(func(g relationGeometry) string { return fmt.Sprint(g.health.X) }))
+	t.animate(canvas.Writer, "y", values(func(g relationGeometry) string { return fmt.Sprint(g.health.Y) }))
+	io.WriteString(canvas.Writer, "</use>\n")
+
+	connectors := []struct {
+		p   image.Point
+		get func(g relationGeometry) image.Point
+	}{
+		{g.connectorA, func(g relationGeometry) image.Point { return g.connectorA }},
+		{g.connectorB, func(g relationGeometry) image.Point { return g.connectorB }},
+	}
+	for _, c := range connectors {
+		fmt.Fprintf(canvas.Writer, "<circle cx=\"%d\" cy=\"%d\" r=\"4\" fill=%q>\n", c.p.X, c.p.Y, color)
+		get := c.get
+		t.animate(canvas.Writer, "cx", values(func(g relationGeometry) string { return fmt.Sprint(get(g).X) }))
+		t.animate(canvas.Writer, "cy", values(func(g relationGeometry) string { return fmt.Sprint(get(g).Y) }))
+		io.WriteString(canvas.Writer, "</circle>\n")
+	}
+}
+
+// captionHeight returns the height needed to show the captions, or zero
+// if there are none.
+func (t *timeline) captionHeight() int {
+	if len(t.labels) == 0 {
+		return 0
+	}
+	return captionHeight
+}
+
+// captionGroup draws the caption for each frame, shown only while that
+// frame is displayed, with its top-left corner at the given vertical
+// position.
+func (t *timeline) captionGroup(canvas *svg.SVG, y int) {
+	if len(t.labels) == 0 {
+		return
+	}
+	canvas.Group(`id="timeline"`, fmt.Sprintf(`transform="translate(0,%d)"`, y))
+	defer canvas.Gend()
+	for i, label := range t.labels {
+		opacities := make([]string, t.frames)
+		for j := range opacities {
+			opacities[j] = opacity(i == j)
+		}
+		fmt.Fprintf(canvas.Writer, "<text x=\"0\" y=\"%d\" fill=%q opacity=%q>%s", captionHeight-10, fontColor, opacities[0], escapeString(label))
+		t.animate(canvas.Writer, "opacity", opacities)
+		io.WriteString(canvas.Writer, "</text>\n")
+	}
+}
+
+// animate writes an SMIL animate element that sets the given attribute
+// to the given value in each frame. Nothing is written if the value
+// does not change.
+func (t *timeline) animate(w io.Writer, attr string, values []string) {
+	if allEqual(values) {
+		return
+	}
+	fmt.Fprintf(w, "<animate attributeName=%q values=%q %s/>\n", attr, t.values(values), t.attrs())
+}
+
+// values returns the values attribute for an animation taking the given
+// value in each frame. Each value is given twice, for the start and
+// end of the frame's hold period.
+func (t *timeline) values(values []string) string {
+	all := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		all = append(all, v, v)
+	}
+	return strings.Join(all, ";")
+}
+
+// attrs returns the timing attributes for an animation along the
+// timeline.
+func (t *timeline) attrs() string {
+	total := t.duration()
+	keyTimes := make([]string, 0, 2*t.frames)
+	for i := 0; i < t.frames; i++ {
+		start := time.Duration(i) * (t.hold + t.transition)
+		keyTimes = append(keyTimes,
+			fmt.Sprintf("%.4g", float64(start)/float64(total)),
+			fmt.Sprintf("%.4g", float64(start+t.hold)/float64(total)),
+		)
+	}
+	attrs := fmt.Sprintf(`dur="%gs" keyTimes=%q`, total.Seconds(), strings.Join(keyTimes, ";"))
+	if t.repeat {
+		return attrs + ` repeatCount="indefinite"`
+	}
+	return attrs + ` fill="freeze"`
+}
+
+// duration returns the total duration of the timeline.
+func (t *timeline) duration() time.Duration {
+	return time.Duration(t.frames)*t.hold + time.Duration(t.frames-1)*t.transition
+}
+
+// opacity returns the opacity used for an item that is or is not
+// present.
+func opacity(present bool) string {
+	if present {
+		return "1"
+	}
+	return "0"
+}
+
+// allEqual reports whether all the given values are the same.
+func allEqual(values []string) bool {
+	for _, v := range values {
+		if v != values[0] {
+			return false
+		}
+	}
+	return true
+}
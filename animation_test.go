@@ -0,0 +1,142 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+func TestNewAnimationFromBundles(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	oldb, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	newb, err := charm.ReadBundleData(strings.NewReader(newBundle))
+	c.Assert(err, qt.IsNil)
+	newb.Applications["elasticsearch"].Annotations["gui-x"] = "690"
+
+	fetcher := &countingFetcher{}
+	cvs, err := NewAnimationFromBundles(ctx, []*charm.BundleData{oldb, newb}, AnimationOptions{
+		Hold:   2 * time.Second,
+		Labels: []string{"before", "after"},
+	}, iconURL, fetcher)
+	c.Assert(err, qt.IsNil)
+	// Icons are only requested once for each charm.
+	c.Assert(fetcher.requested, qt.DeepEquals, map[string]int{
+		"cs:~juju-jitsu/precise/charmworld-58":      1,
+		"cs:~charming-devs/precise/elasticsearch-2": 1,
+		"cs:~charming-devs/precise/elasticsearch-3": 1,
+		"cs:precise/mongodb-21":                     1,
+		"cs:precise/haproxy-35":                     1,
+	})
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Logf("%s", buf.String())
+	out := buf.String()
+	c.Assert(out, qt.Contains, `<svg width="791" height="487"`)
+	// Moved applications are animated between positions.
+	c.Assert(out, qt.Contains, `<title>elasticsearch</title>
+<animateTransform attributeName="transform" type="translate" values="0,257;0,257;200,257;200,257" dur="5s" keyTimes="0;0.4;0.6;1" fill="freeze"/>
+`)
+	// Applications that do not move are not animated.
+	c.Assert(out, qt.Contains, `<title>charmworld</title>
+<circle `)
+	// Removed and added applications fade out and in.
+	c.Assert(out, qt.Contains, `<title>mongodb</title>
+<animate attributeName="opacity" values="1;1;0;0" dur="5s" keyTimes="0;0.4;0.6;1" fill="freeze"/>
+`)
+	c.Assert(out, qt.Contains, `<title>haproxy</title>
+<animate attributeName="opacity" values="0;0;1;1" dur="5s" keyTimes="0;0.4;0.6;1" fill="freeze"/>
+`)
+	// Relations follow the applications they relate.
+	c.Assert(out, qt.Contains, `<title>charmworld:essearch elasticsearch:essearch</title>
+<line x1="413" y1="90" x2="90" y2="347" stroke="#a7a7a7" stroke-width="1px" stroke-dasharray="198.38, 16">
+<animate attributeName="x2" values="90;90;290;290" dur="5s" keyTimes="0;0.4;0.6;1" fill="freeze"/>
+<animate attributeName="stroke-dasharray" values="198.38, 16;198.38, 16;134.46, 16;134.46, 16" dur="5s" keyTimes="0;0.4;0.6;1" fill="freeze"/>
+</line>
+<use x="243" y="210" xlink:href="#healthCircle">
+<animate attributeName="x" values="243;243;343;343" dur="5s" keyTimes="0;0.4;0.6;1" fill="freeze"/>
+</use>
+`)
+	c.Assert(out, qt.Contains, `<title>charmworld:database mongodb:database</title>
+<animate attributeName="opacity" values="1;1;0;0" dur="5s" keyTimes="0;0.4;0.6;1" fill="freeze"/>
+`)
+	// Each caption is shown in turn.
+	c.Assert(out, qt.Contains, `<g id="timeline" transform="translate(0,457)" >
+<text x="0" y="20" fill="#505050" opacity="1">before<animate attributeName="opacity" values="1;1;0;0" dur="5s" keyTimes="0;0.4;0.6;1" fill="freeze"/>
+</text>
+<text x="0" y="20" fill="#505050" opacity="0">after<animate attributeName="opacity" values="0;0;1;1" dur="5s" keyTimes="0;0.4;0.6;1" fill="freeze"/>
+</text>
+</g>`)
+	// The output is still valid XML.
+	xmlTokens(c, buf.Bytes())
+}
+
+func TestNewAnimationFromBundlesRepeat(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	oldb, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	newb, err := charm.ReadBundleData(strings.NewReader(newBundle))
+	c.Assert(err, qt.IsNil)
+
+	cvs, err := NewAnimationFromBundles(ctx, []*charm.BundleData{oldb, newb, oldb}, AnimationOptions{
+		Repeat: true,
+	}, iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), qt.Contains, `<title>mongodb</title>
+<animate attributeName="opacity" values="1;1;0;0;1;1" dur="5s" keyTimes="0;0.2;0.4;0.6;0.8;1" repeatCount="indefinite"/>
+`)
+	c.Assert(buf.String(), qt.Not(qt.Contains), `id="timeline"`)
+}
+
+func TestNewAnimationFromBundlesErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	cvs, err := NewAnimationFromBundles(ctx, nil, AnimationOptions{}, iconURL, nil)
+	c.Assert(err, qt.ErrorMatches, "no bundles to animate")
+	c.Assert(cvs, qt.IsNil)
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	cvs, err = NewAnimationFromBundles(ctx, []*charm.BundleData{b}, AnimationOptions{
+		Labels: []string{"a", "b"},
+	}, iconURL, nil)
+	c.Assert(err, qt.ErrorMatches, "got 2 labels for 1 bundles")
+	c.Assert(cvs, qt.IsNil)
+
+	bad, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	bad.Relations[0][0] = "evil-unknown-application"
+	cvs, err = NewAnimationFromBundles(ctx, []*charm.BundleData{b, bad}, AnimationOptions{}, iconURL, nil)
+	c.Assert(err, qt.ErrorMatches, "cannot draw bundle 1: cannot verify bundle: .*")
+	c.Assert(cvs, qt.IsNil)
+}
+
+// countingFetcher is an IconFetcher that records how many times the
+// icon for each charm is requested.
+type countingFetcher struct {
+	requested map[string]int
+}
+
+func (f *countingFetcher) FetchIcons(_ context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	if f.requested == nil {
+		f.requested = make(map[string]int)
+	}
+	for _, app := range b.Applications {
+		f.requested[app.Charm]++
+	}
+	return nil, nil
+}
@@ -0,0 +1,6 @@
+package assets
+
+// This is the SVG used in place of a charm icon that cannot be fetched.
+var CharmIconFallback = `
+<svg xmlns="http://www.w3.org/2000/svg" width="96" height="96" viewBox="0 0 96 96"><circle cx="48" cy="48" r="48" fill="#d8d8d8"/><path d="M48 20l24 13.86v27.71L48 75.43 24 61.57V33.86z" fill="none" stroke="#888" stroke-width="4" stroke-linejoin="round"/><path d="M24 33.86l24 13.85 24-13.85M48 47.71v27.72" fill="none" stroke="#888" stroke-width="4" stroke-linejoin="round"/></svg>
+`
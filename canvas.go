@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"image"
 	"io"
+	"io/ioutil"
 	"math"
 
 	svg "github.com/ajstarks/svgo"
+	"gopkg.in/errgo.v1"
 
 	"github.com/juju/jujusvg/v4/assets"
 )
@@ -24,6 +26,10 @@ const (
 
 	fontColor     = "#505050"
 	relationColor = "#a7a7a7"
+
+	legendRowHeight = 24
+	legendSwatch    = 14
+	legendMinWidth  = 200
 )
 
 // Canvas holds the parsed form of a bundle or model.
@@ -32,6 +38,26 @@ type Canvas struct {
 	relations     []*applicationRelation
 	iconsRendered map[string]bool
 	iconIds       map[string]string
+
+	// legend holds the highlights used on the canvas, in the order in
+	// which they are listed in the legend.
+	legend []*highlight
+
+	// timeline holds the timeline of an animated canvas, or nil
+	// if the canvas is not animated.
+	timeline *timeline
+
+	// iconLimits holds the limits set by SetIconLimits, or nil if
+	// DefaultIconLimits should be used.
+	iconLimits *IconLimits
+
+	// minify holds how icons are minified, as set by MinifyIcons,
+	// or nil if they are not.
+	minify *iconMinifier
+
+	// origin holds the offset by which layout has moved the
+	// applications from their original positions.
+	origin image.Point
 }
 
 // application represents a application deployed to a model and contains the
@@ -42,13 +68,57 @@ type application struct {
 	iconUrl   string
 	iconSrc   []byte
 	point     image.Point
+	highlight *highlight
+
+	// ownIcon holds whether the application's icon has been
+	// overridden for it alone, rather than being shared with other
+	// applications using the same charm.
+	ownIcon bool
+
+	// saas holds whether the application is a SAAS entry, which
+	// consumes an offer from another model, rather than an
+	// application in the bundle.
+	saas bool
+
+	// frames holds the state of the application in each frame of
+	// an animated canvas, timed according to timeline.
+	frames   []frame
+	timeline *timeline
 }
 
 // applicationRelation represents a relation created between two applications.
 type applicationRelation struct {
 	name         string
+	endpointA    string
+	endpointB    string
 	applicationA *application
 	applicationB *application
+	highlight    *highlight
+
+	// present holds whether the relation is present in each frame
+	// of an animated canvas.
+	present []bool
+}
+
+// highlight describes how an application or relation is emphasised, for
+// instance to show how it differs from another bundle.
+type highlight struct {
+	// label describes the highlight in the legend.
+	label string
+	// color is used to draw the highlighted items.
+	color string
+	// faded specifies that highlighted items are drawn faded and
+	// dashed, as for items that are no longer present.
+	faded bool
+}
+
+// attrs returns the attributes used for the outline of a highlighted item.
+func (h *highlight) attrs() string {
+	attrs := fmt.Sprintf(`stroke=%q`, h.color)
+	if h.faded {
+		attrs += ` stroke-dasharray="8, 4" opacity="0.5"`
+	}
+	return attrs
 }
 
 // line represents a line segment with two endpoints.
@@ -57,16 +127,46 @@ type line struct {
 }
 
 // definition creates any necessary defs that can be used later in the SVG.
-func (s *application) definition(canvas *svg.SVG, iconsRendered map[string]bool, iconIds map[string]string) error {
-	if len(s.iconSrc) == 0 || iconsRendered[s.charmPath] {
-		return nil
+// If the icon cannot be embedded, nothing is written and the application
+// is drawn with a link to its icon URL instead.
+func (s *application) definition(canvas *svg.SVG, iconsRendered map[string]bool, iconIds map[string]string, opts iconOptions) error {
+	icon, err := s.embedIcon(iconsRendered, iconIds, opts)
+	if err != nil || icon == nil {
+		return err
+	}
+	_, err = canvas.Writer.Write(icon)
+	return err
+}
+
+// embedIcon allocates an id for the application's icon, recording it in
+// iconIds, and returns the icon processed for embedding with that id.
+// It returns nil if the icon has already been embedded, and an error if
+// it cannot be embedded, in which case no id is recorded. The keys of
+// the icons that have been considered are recorded in iconsRendered.
+func (s *application) embedIcon(iconsRendered map[string]bool, iconIds map[string]string, opts iconOptions) ([]byte, error) {
+	key := s.iconKey()
+	if len(s.iconSrc) == 0 || iconsRendered[key] {
+		return nil, nil
+	}
+	iconsRendered[key] = true
+	id := fmt.Sprintf("icon-%d", len(iconsRendered))
+
+	opts.trustedURL = s.iconUrl
+	var buf bytes.Buffer
+	if _, err := processIcon(bytes.NewReader(s.iconSrc), &buf, id, opts); err != nil {
+		return nil, errgo.Mask(err)
 	}
-	iconsRendered[s.charmPath] = true
-	iconIds[s.charmPath] = fmt.Sprintf("icon-%d", len(iconsRendered))
+	iconIds[key] = id
+	return buf.Bytes(), nil
+}
 
-	// Temporary solution:
-	iconBuf := bytes.NewBuffer(s.iconSrc)
-	return processIcon(iconBuf, canvas.Writer, iconIds[s.charmPath])
+// iconKey returns the key identifying the application's icon among those
+// on the canvas, so that each icon is embedded only once.
+func (s *application) iconKey() string {
+	if s.ownIcon {
+		return "application:" + s.name
+	}
+	return s.charmPath
 }
 
 // usage creates any necessary tags for actually using the application in the SVG.
@@ -74,19 +174,30 @@ func (s *application) usage(canvas *svg.SVG, iconIds map[string]string) {
 	canvas.Group(fmt.Sprintf(`transform="translate(%d,%d)"`, s.point.X, s.point.Y))
 	defer canvas.Gend()
 	canvas.Title(s.name)
+	if len(s.frames) > 0 {
+		s.animate(canvas)
+	}
+	blockAttrs := `class="application-block" fill="#f5f5f5" stroke="#888" stroke-width="1"`
+	if s.saas {
+		blockAttrs += ` stroke-dasharray="6, 3"`
+	}
+	if s.highlight != nil {
+		blockAttrs = `class="application-block" fill="#f5f5f5" stroke-width="4" ` + s.highlight.attrs()
+	}
 	canvas.Circle(
 		applicationBlockSize/2,
 		applicationBlockSize/2,
 		applicationBlockSize/2,
-		`class="application-block" fill="#f5f5f5" stroke="#888" stroke-width="1"`)
-	if len(s.iconSrc) > 0 {
+		blockAttrs)
+	if iconIds[s.iconKey()] != "" {
 		canvas.Use(
 			0,
 			0,
-			"#"+iconIds[s.charmPath],
+			"#"+iconIds[s.iconKey()],
 			fmt.Sprintf(`transform="translate(%d,%d)" width="%d" height="%d" clip-path="url(#clip-mask)"`, applicationBlockSize/2-iconSize/2, applicationBlockSize/2-iconSize/2, iconSize, iconSize),
 		)
-	} else {
+	} else if !s.saas {
+		// SAAS entries have no icon URL to link to.
 		canvas.Image(
 			applicationBlockSize/2-iconSize/2,
 			applicationBlockSize/2-iconSize/2,
@@ -119,36 +230,82 @@ func (r *applicationRelation) definition(canvas *svg.SVG) {
 
 // usage creates any necessary tags for actually using the relation in the SVG.
 func (r *applicationRelation) usage(canvas *svg.SVG) {
-	canvas.Group()
+	color := relationColor
+	var groupAttrs []string
+	if r.highlight != nil {
+		color = r.highlight.color
+		if r.highlight.faded {
+			groupAttrs = append(groupAttrs, `opacity="0.5"`)
+		}
+	}
+	canvas.Group(groupAttrs...)
 	defer canvas.Gend()
 	canvas.Title(r.name)
-	l := line{
-		p0: r.applicationA.point.Add(point(applicationBlockSize/2, applicationBlockSize/2)),
-		p1: r.applicationB.point.Add(point(applicationBlockSize/2, applicationBlockSize/2)),
+	if len(r.present) > 0 {
+		r.animatedUsage(canvas, color)
+		return
 	}
+	g := r.geometry()
 	canvas.Line(
-		l.p0.X,
-		l.p0.Y,
-		l.p1.X,
-		l.p1.Y,
-		fmt.Sprintf(`stroke=%q`, relationColor),
+		g.line.p0.X,
+		g.line.p0.Y,
+		g.line.p1.X,
+		g.line.p1.Y,
+		fmt.Sprintf(`stroke=%q`, color),
 		fmt.Sprintf(`stroke-width="%dpx"`, relationLineWidth),
-		fmt.Sprintf(`stroke-dasharray=%q`, strokeDashArray(l)),
+		fmt.Sprintf(`stroke-dasharray=%q`, strokeDashArray(g.line)),
 	)
-	mid := l.p0.Add(l.p1).Div(2).Sub(point(healthCircleRadius, healthCircleRadius))
-	canvas.Use(mid.X, mid.Y, "#healthCircle")
-
-	deg := math.Atan2(float64(l.p0.Y-l.p1.Y), float64(l.p0.X-l.p1.X))
+	canvas.Use(g.health.X, g.health.Y, "#healthCircle")
 	canvas.Circle(
-		int(float64(l.p0.X)-math.Cos(deg)*(applicationBlockSize/2)),
-		int(float64(l.p0.Y)-math.Sin(deg)*(applicationBlockSize/2)),
+		g.connectorA.X,
+		g.connectorA.Y,
 		4,
-		fmt.Sprintf(`fill=%q`, relationColor))
+		fmt.Sprintf(`fill=%q`, color))
 	canvas.Circle(
-		int(float64(l.p1.X)+math.Cos(deg)*(applicationBlockSize/2)),
-		int(float64(l.p1.Y)+math.Sin(deg)*(applicationBlockSize/2)),
+		g.connectorB.X,
+		g.connectorB.Y,
 		4,
-		fmt.Sprintf(`fill=%q`, relationColor))
+		fmt.Sprintf(`fill=%q`, color))
+}
+
+// relationGeometry holds the computed positions of the elements used to
+// draw a relation.
+type relationGeometry struct {
+	// line runs between the centres of the two application blocks.
+	line line
+	// health is the top-left corner of the relation health indicator.
+	health image.Point
+	// connectorA and connectorB are the points where the line crosses
+	// the edges of the application blocks.
+	connectorA, connectorB image.Point
+}
+
+// geometry computes where the relation is drawn given the current
+// positions of its applications.
+func (r *applicationRelation) geometry() relationGeometry {
+	return relationGeometryBetween(r.applicationA.point, r.applicationB.point)
+}
+
+// relationGeometryBetween computes where a relation is drawn between
+// applications with the given positions.
+func relationGeometryBetween(a, b image.Point) relationGeometry {
+	l := line{
+		p0: a.Add(point(applicationBlockSize/2, applicationBlockSize/2)),
+		p1: b.Add(point(applicationBlockSize/2, applicationBlockSize/2)),
+	}
+	deg := math.Atan2(float64(l.p0.Y-l.p1.Y), float64(l.p0.X-l.p1.X))
+	return relationGeometry{
+		line:   l,
+		health: l.p0.Add(l.p1).Div(2).Sub(point(healthCircleRadius, healthCircleRadius)),
+		connectorA: point(
+			int(float64(l.p0.X)-math.Cos(deg)*(applicationBlockSize/2)),
+			int(float64(l.p0.Y)-math.Sin(deg)*(applicationBlockSize/2)),
+		),
+		connectorB: point(
+			int(float64(l.p1.X)+math.Cos(deg)*(applicationBlockSize/2)),
+			int(float64(l.p1.Y)+math.Sin(deg)*(applicationBlockSize/2)),
+		),
+	}
 }
 
 // strokeDashArray generates the stroke-dasharray attribute content so that
@@ -163,6 +320,16 @@ func (l *line) length() float64 {
 	return math.Sqrt(square(float64(dp.X)) + square(float64(dp.Y)))
 }
 
+// points returns all the positions that the application takes on the
+// canvas.
+func (s *application) points() []image.Point {
+	points := []image.Point{s.point}
+	for _, f := range s.frames {
+		points = append(points, f.point)
+	}
+	return points
+}
+
 // addApplication adds a new application to the canvas.
 func (c *Canvas) addApplication(s *application) {
 	c.applications = append(c.applications, s)
@@ -182,22 +349,28 @@ func (c *Canvas) layout() (int, int) {
 	maxHeight := minInt
 
 	for _, application := range c.applications {
-		if application.point.X < minWidth {
-			minWidth = application.point.X
-		}
-		if application.point.Y < minHeight {
-			minHeight = application.point.Y
-		}
-		if application.point.X > maxWidth {
-			maxWidth = application.point.X
-		}
-		if application.point.Y > maxHeight {
-			maxHeight = application.point.Y
+		for _, p := range application.points() {
+			if p.X < minWidth {
+				minWidth = p.X
+			}
+			if p.Y < minHeight {
+				minHeight = p.Y
+			}
+			if p.X > maxWidth {
+				maxWidth = p.X
+			}
+			if p.Y > maxHeight {
+				maxHeight = p.Y
+			}
 		}
 	}
 	for _, application := range c.applications {
 		application.point = application.point.Sub(point(minWidth, minHeight))
+		for i := range application.frames {
+			application.frames[i].point = application.frames[i].point.Sub(point(minWidth, minHeight))
+		}
 	}
+	c.origin = c.origin.Add(point(minWidth, minHeight))
 	return abs(maxWidth-minWidth) + applicationBlockSize + 1,
 		abs(maxHeight-minHeight) + applicationBlockSize + 1
 }
@@ -217,7 +390,7 @@ func (c *Canvas) definition(canvas *svg.SVG) {
 		relation.definition(canvas)
 	}
 	for _, application := range c.applications {
-		application.definition(canvas, c.iconsRendered, c.iconIds)
+		application.definition(canvas, c.iconsRendered, c.iconIds, c.iconOptions())
 	}
 }
 
@@ -237,6 +410,48 @@ func (c *Canvas) applicationsGroup(canvas *svg.SVG) {
 	}
 }
 
+// addHighlight adds a highlight to the canvas legend, if it is not already
+// present.
+func (c *Canvas) addHighlight(h *highlight) {
+	for _, existing := range c.legend {
+		if existing == h {
+			return
+		}
+	}
+	c.legend = append(c.legend, h)
+}
+
+// legendSize returns the size of the legend, or zero if there is none.
+func (c *Canvas) legendSize() (int, int) {
+	if len(c.legend) == 0 {
+		return 0, 0
+	}
+	return legendMinWidth, len(c.legend)*legendRowHeight + legendRowHeight/2
+}
+
+// legendGroup draws the legend with its top-left corner at the given
+// vertical position.
+func (c *Canvas) legendGroup(canvas *svg.SVG, y int) {
+	if len(c.legend) == 0 {
+		return
+	}
+	canvas.Group(`id="legend"`, fmt.Sprintf(`transform="translate(0,%d)"`, y))
+	defer canvas.Gend()
+	for i, h := range c.legend {
+		rowY := legendRowHeight/2 + i*legendRowHeight
+		attrs := fmt.Sprintf(`fill=%q`, h.color)
+		if h.faded {
+			attrs += ` opacity="0.5"`
+		}
+		canvas.Rect(0, rowY, legendSwatch, legendSwatch, attrs)
+		canvas.Text(
+			legendSwatch+8,
+			rowY+legendSwatch-2,
+			h.label,
+			fmt.Sprintf(`fill=%q`, fontColor))
+	}
+}
+
 func (c *Canvas) iconClipPath(canvas *svg.SVG) {
 	canvas.Circle(
 		applicationBlockSize/2-iconSize/2+5, // for these two, add an offset to help
@@ -264,6 +479,17 @@ func (c *Canvas) Marshal(w io.Writer) {
 	// is to wrap the writer in a custom writer that panics
 	// on error, and catch the panic here.
 	width, height := c.layout()
+	contentHeight := height
+	if c.timeline != nil {
+		height += c.timeline.captionHeight()
+	}
+	legendY := height
+	if legendWidth, legendHeight := c.legendSize(); legendHeight > 0 {
+		if legendWidth > width {
+			width = legendWidth
+		}
+		height += legendHeight
+	}
 
 	canvas := svg.New(w)
 	canvas.Start(
@@ -277,6 +503,30 @@ func (c *Canvas) Marshal(w io.Writer) {
 	c.iconClipPath(canvas)
 	c.relationsGroup(canvas)
 	c.applicationsGroup(canvas)
+	if c.timeline != nil {
+		c.timeline.captionGroup(canvas, contentHeight)
+	}
+	c.legendGroup(canvas, legendY)
+}
+
+// StrippedFromIcons returns descriptions of the content that is removed
+// from each icon when it is sanitised for inclusion in the SVG, keyed by
+// charm path. Icons from which nothing is removed are omitted.
+func (c *Canvas) StrippedFromIcons() map[string][]string {
+	stripped := make(map[string][]string)
+	for _, application := range c.applications {
+		if len(application.iconSrc) == 0 || stripped[application.iconKey()] != nil {
+			continue
+		}
+		removed, err := processIcon(bytes.NewReader(application.iconSrc), ioutil.Discard, "icon", iconOptions{
+			trustedURL: application.iconUrl,
+			limits:     c.limits(),
+		})
+		if err == nil && len(removed) > 0 {
+			stripped[application.iconKey()] = removed
+		}
+	}
+	return stripped
 }
 
 // abs returns the absolute value of a number.
@@ -91,7 +91,7 @@ func TestApplicationRender(t *testing.T) {
 		c.Run(test.about, func(c *qt.C) {
 			var buf bytes.Buffer
 			svg := svg.New(&buf)
-			test.application.definition(svg, iconsRendered, iconIds)
+			test.application.definition(svg, iconsRendered, iconIds, iconOptions{limits: DefaultIconLimits})
 			test.application.usage(svg, iconIds)
 			c.Log(test.about)
 			c.Log(buf.String())
@@ -278,6 +278,73 @@ func TestMarshal(t *testing.T) {
 `))
 }
 
+func TestMarshalIconIDs(t *testing.T) {
+	c := qt.New(t)
+
+	// Icons that use the same ids internally do not clash.
+	icon := func(color string) []byte {
+		return []byte(`
+			<svg xmlns="http://www.w3.org/2000/svg">
+				<linearGradient id="linearGradient1"><stop stop-color="` + color + `"/></linearGradient>
+				<circle r="20" fill="url(#linearGradient1)"/>
+			</svg>`)
+	}
+	var canvas Canvas
+	canvas.addApplication(&application{
+		name:      "application-a",
+		charmPath: "trusty/svc-a",
+		iconSrc:   icon("red"),
+	})
+	canvas.addApplication(&application{
+		name:      "application-b",
+		charmPath: "trusty/svc-b",
+		iconSrc:   icon("blue"),
+	})
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	out := buf.String()
+	c.Assert(out, qt.Contains, `<linearGradient id="icon-1-linearGradient1"><stop stop-color="red"></stop></linearGradient>`)
+	c.Assert(out, qt.Contains, `<circle r="20" fill="url(#icon-1-linearGradient1)"></circle>`)
+	c.Assert(out, qt.Contains, `<linearGradient id="icon-2-linearGradient1"><stop stop-color="blue"></stop></linearGradient>`)
+	c.Assert(out, qt.Contains, `<circle r="20" fill="url(#icon-2-linearGradient1)"></circle>`)
+}
+
+func TestStrippedFromIcons(t *testing.T) {
+	c := qt.New(t)
+
+	var canvas Canvas
+	canvas.addApplication(&application{
+		name:      "application-a",
+		charmPath: "trusty/svc-a",
+		iconSrc: []byte(`
+			<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)">
+				<script>alert(2)</script>
+			</svg>`),
+	})
+	canvas.addApplication(&application{
+		name:      "application-b",
+		charmPath: "trusty/svc-a",
+		iconSrc: []byte(`
+			<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)">
+				<script>alert(2)</script>
+			</svg>`),
+	})
+	// The icon URL of the charm may be referred to, as LinkFetcher
+	// does.
+	canvas.addApplication(&application{
+		name:      "application-c",
+		charmPath: "trusty/svc-c",
+		iconUrl:   "https://example.com/svc-c.svg",
+		iconSrc: []byte(`
+			<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">
+				<image xlink:href="https://example.com/svc-c.svg"/>
+			</svg>`),
+	})
+	c.Assert(canvas.StrippedFromIcons(), qt.DeepEquals, map[string][]string{
+		"trusty/svc-a": {"attribute onload", "element script"},
+	})
+}
+
 func assertXMLEqual(c *qt.C, obtained, expected []byte) {
 	toksObtained := xmlTokens(c, obtained)
 	toksExpected := xmlTokens(c, expected)
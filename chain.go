@@ -0,0 +1,121 @@
+package jujusvg
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+// IconSource holds an IconFetcher used by a ChainFetcher, along with a
+// name describing it.
+type IconSource struct {
+	// Name describes the source, for instance "mirror".
+	Name string
+
+	// Fetcher is used to fetch icons from the source.
+	Fetcher IconFetcher
+}
+
+// ChainFetcher is an IconFetcher that tries each of a list of sources in
+// turn, taking the first icon found for each charm. Only the charms whose
+// icons have not yet been found are passed on to each source.
+type ChainFetcher struct {
+	// Sources holds the sources to try, in order.
+	Sources []IconSource
+
+	// mu guards iconSources.
+	mu          sync.Mutex
+	iconSources map[string]string
+}
+
+// FetchIcons implements IconFetcher.FetchIcons. A source that fails to
+// fetch some or all of the icons asked of it does not stop the others
+// being tried. If no source could supply an icon for a charm and at
+// least one of them failed, the icons that were found are returned
+// along with an IconErrors error holding the last failure for each such
+// charm. Charms that no source has an icon for are otherwise omitted.
+func (f *ChainFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	// Map each charm path to the applications using it, so that the
+	// icons still needed can be fetched with a bundle of just those
+	// applications.
+	paths := make(map[string][]string)
+	for name, applicationData := range b.Applications {
+		_, path, err := parseCharm(applicationData.Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse charm %q", applicationData.Charm)
+		}
+		paths[path] = append(paths[path], name)
+	}
+	icons := make(map[string][]byte)
+	iconSources := make(map[string]string)
+	iconErrs := make(IconErrors)
+	for _, source := range f.Sources {
+		remaining := &charm.BundleData{
+			Applications: make(map[string]*charm.ApplicationSpec),
+		}
+		for path, names := range paths {
+			if icons[path] != nil {
+				continue
+			}
+			for _, name := range names {
+				remaining.Applications[name] = b.Applications[name]
+			}
+		}
+		if len(remaining.Applications) == 0 {
+			break
+		}
+		fetched, err := source.Fetcher.FetchIcons(ctx, remaining)
+		if ctx.Err() != nil {
+			return nil, errgo.NoteMask(ctx.Err(), "cannot fetch icons", errgo.Any)
+		}
+		if err != nil {
+			if partial, ok := errgo.Cause(err).(IconErrors); ok {
+				for path, err := range partial {
+					iconErrs[path] = errgo.Notef(err, "%s", source.Name)
+				}
+			} else {
+				fetched = nil
+				for path := range paths {
+					if icons[path] == nil {
+						iconErrs[path] = errgo.Notef(err, "%s", source.Name)
+					}
+				}
+			}
+		}
+		for path, icon := range fetched {
+			if _, ok := paths[path]; !ok || icon == nil || icons[path] != nil {
+				continue
+			}
+			icons[path] = icon
+			iconSources[path] = source.Name
+			delete(iconErrs, path)
+		}
+	}
+	f.mu.Lock()
+	if f.iconSources == nil {
+		f.iconSources = make(map[string]string)
+	}
+	for path, name := range iconSources {
+		f.iconSources[path] = name
+	}
+	f.mu.Unlock()
+	if len(iconErrs) > 0 {
+		return icons, iconErrs
+	}
+	return icons, nil
+}
+
+// IconSources returns the name of the source that supplied each icon
+// fetched so far, keyed by charm path. If an icon has been fetched more
+// than once, the most recent source is given.
+func (f *ChainFetcher) IconSources() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	iconSources := make(map[string]string, len(f.iconSources))
+	for path, name := range f.iconSources {
+		iconSources[path] = name
+	}
+	return iconSources
+}
@@ -0,0 +1,103 @@
+package jujusvg
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+func TestChainFetcher(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	mirror := &pathFetcher{}
+	store := &pathFetcher{}
+	fetcher := &ChainFetcher{
+		Sources: []IconSource{{
+			Name: "overrides",
+			Fetcher: IconMap{
+				"precise/mongodb-21": []byte("<svg>override</svg>"),
+				"precise/haproxy-35": []byte("<svg>unused</svg>"),
+			},
+		}, {
+			Name: "mirror",
+			Fetcher: &partialFetcher{
+				Fetcher: mirror,
+				fail:    "~juju-jitsu/precise/charmworld-58",
+			},
+		}, {
+			Name:    "store",
+			Fetcher: store,
+		}},
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                     []byte("<svg>override</svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>~charming-devs/precise/elasticsearch-2</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>~juju-jitsu/precise/charmworld-58</svg>"),
+	})
+	c.Assert(fetcher.IconSources(), qt.DeepEquals, map[string]string{
+		"precise/mongodb-21":                     "overrides",
+		"~charming-devs/precise/elasticsearch-2": "mirror",
+		"~juju-jitsu/precise/charmworld-58":      "store",
+	})
+	// Each source is asked only for the icons still needed.
+	c.Assert(mirror.fetched, qt.DeepEquals, map[string]int{
+		"~charming-devs/precise/elasticsearch-2": 1,
+		"~juju-jitsu/precise/charmworld-58":      1,
+	})
+	c.Assert(store.fetched, qt.DeepEquals, map[string]int{
+		"~juju-jitsu/precise/charmworld-58": 1,
+	})
+}
+
+func TestChainFetcherErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	mirrorErr := errFetcher("mirror down")
+	fetcher := &ChainFetcher{
+		Sources: []IconSource{{
+			Name: "overrides",
+			Fetcher: IconMap{
+				"precise/mongodb-21": []byte("<svg>override</svg>"),
+			},
+		}, {
+			Name:    "mirror",
+			Fetcher: &mirrorErr,
+		}, {
+			Name: "store",
+			Fetcher: &partialFetcher{
+				Fetcher: &pathFetcher{},
+				fail:    "~juju-jitsu/precise/charmworld-58",
+			},
+		}},
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(icons, qt.HasLen, 2)
+	iconErrs, ok := errgo.Cause(err).(IconErrors)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(iconErrs, qt.HasLen, 1)
+	c.Assert(iconErrs["~juju-jitsu/precise/charmworld-58"], qt.ErrorMatches, `store: .*`)
+
+	// Without the last source, the mirror's error is reported.
+	fetcher.Sources = fetcher.Sources[:2]
+	icons, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(icons, qt.HasLen, 1)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "~charming-devs/precise/elasticsearch-2": mirror: mirror down \(and 1 more\)`)
+
+	// A context that is done stops the chain.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icons: context canceled`)
+}
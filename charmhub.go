@@ -0,0 +1,173 @@
+package jujusvg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// DefaultCharmhubURL holds the URL of the Charmhub API used by
+	// CharmhubFetcher when no other is specified.
+	DefaultCharmhubURL = "https://api.charmhub.io"
+
+	// charmhubSchema holds the schema of Charmhub charm references,
+	// such as ch:mysql.
+	charmhubSchema = "ch"
+)
+
+// CharmhubFetcher is an IconFetcher that looks up the icons of charms
+// with a Charmhub-style API and then fetches them over HTTP. Charmhub
+// charms, such as ch:mysql, are looked up by name in the channel given
+// for their application in the bundle, if any. Charm store charms that
+// do not belong to a user are looked up by name too, ignoring their
+// series and revision. Other charms are given icons by
+// FallbackIconURL. Charms with no icon are omitted.
+//
+// A CharmhubFetcher is safe for concurrent use.
+type CharmhubFetcher struct {
+	// URL holds the base URL of the API. If it is empty,
+	// DefaultCharmhubURL is used.
+	URL string
+
+	// Fetcher specifies how icons and charm information are fetched.
+	// Its IconURL field is ignored. If it is nil, a zero HTTPFetcher
+	// is used.
+	Fetcher *HTTPFetcher
+
+	// FallbackIconURL, if not nil, returns the icon URL of charms
+	// that cannot be looked up in Charmhub, such as charm store
+	// charms that belong to a user. If it is nil, those charms
+	// have no icon.
+	FallbackIconURL func(context.Context, *charm.URL) (string, error)
+
+	// mu guards found.
+	mu sync.Mutex
+
+	// found holds the icon URL most recently found for each charm,
+	// keyed by charm URL, so that IconURL need not look it up again.
+	found map[string]string
+}
+
+// charmInfo holds the parts of the response to a Charmhub info request
+// used by CharmhubFetcher.
+type charmInfo struct {
+	Result struct {
+		Media []struct {
+			Type string `json:"type"`
+			URL  string `json:"url"`
+		} `json:"media"`
+	} `json:"result"`
+}
+
+// FetchIcons implements IconFetcher.FetchIcons. As icons are held by
+// charm, when applications use the same charm in different channels,
+// the channel of the first application in alphabetical order is used.
+func (f *CharmhubFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	names := make([]string, 0, len(b.Applications))
+	for name := range b.Applications {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// applications holds the application used to look up each
+	// charm, keyed by charm URL.
+	applications := make(map[string]string)
+	for _, name := range names {
+		charmId, _, err := parseCharm(b.Applications[name].Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse charm %q", b.Applications[name].Charm)
+		}
+		if _, ok := applications[charmId.String()]; !ok {
+			applications[charmId.String()] = name
+		}
+	}
+	var h HTTPFetcher
+	if f.Fetcher != nil {
+		h = *f.Fetcher
+	}
+	h.IconURL = func(ctx context.Context, charmId *charm.URL) (string, error) {
+		channel := b.Applications[applications[charmId.String()]].Channel
+		iconURL, err := f.iconURL(ctx, charmId, channel)
+		if err != nil {
+			return "", errgo.Mask(err, errgo.Any)
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.found == nil {
+			f.found = make(map[string]string)
+		}
+		f.found[charmId.String()] = iconURL
+		return iconURL, nil
+	}
+	icons, err := h.FetchIcons(ctx, b)
+	return icons, errgo.Mask(err, errgo.Any)
+}
+
+// IconURL returns the URL of the icon of the given charm, or the empty
+// string if it has no icon. If the charm's icon was found by FetchIcons,
+// that URL is returned; otherwise the charm is looked up in its default
+// channel. It can be used as the iconURL argument to NewFromBundle.
+func (f *CharmhubFetcher) IconURL(ctx context.Context, charmId *charm.URL) (string, error) {
+	f.mu.Lock()
+	iconURL, ok := f.found[charmId.String()]
+	f.mu.Unlock()
+	if ok {
+		return iconURL, nil
+	}
+	return f.iconURL(ctx, charmId, "")
+}
+
+// iconURL returns the URL of the icon of the given charm in the given
+// channel, or the empty string if it has no icon.
+func (f *CharmhubFetcher) iconURL(ctx context.Context, charmId *charm.URL, channel string) (string, error) {
+	if charmId.Schema != charmhubSchema && (charmId.Schema != "cs" || charmId.User != "") {
+		if f.FallbackIconURL == nil {
+			return "", nil
+		}
+		return f.FallbackIconURL(ctx, charmId)
+	}
+	baseURL := f.URL
+	if baseURL == "" {
+		baseURL = DefaultCharmhubURL
+	}
+	query := url.Values{
+		"fields": {"result.media"},
+	}
+	if channel != "" {
+		query.Set("channel", channel)
+	}
+	infoURL := strings.TrimSuffix(baseURL, "/") + "/v2/charms/info/" + url.PathEscape(charmId.Name) + "?" + query.Encode()
+	req, err := http.NewRequest("GET", infoURL, nil)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot make request for %s", infoURL)
+	}
+	client := http.DefaultClient
+	if f.Fetcher != nil && f.Fetcher.Client != nil {
+		client = f.Fetcher.Client
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errgo.Notef(err, "HTTP error fetching %s", infoURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errgo.Newf("cannot retrieve charm information from %s: %s", infoURL, resp.Status)
+	}
+	var info charmInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", errgo.Notef(err, "cannot decode charm information from %s", infoURL)
+	}
+	for _, media := range info.Result.Media {
+		if media.Type == "icon" {
+			return media.URL, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,221 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+const charmhubBundle = `
+applications:
+  mysql:
+    charm: ch:mysql
+    channel: 8.0/stable
+    num_units: 1
+    annotations:
+      gui-x: "0"
+      gui-y: "0"
+  wordpress:
+    charm: cs:trusty/wordpress-5
+    num_units: 1
+    annotations:
+      gui-x: "300"
+      gui-y: "0"
+  plain:
+    charm: ch:plain
+    num_units: 1
+    annotations:
+      gui-x: "600"
+      gui-y: "0"
+relations:
+  - ["wordpress:db", "mysql:db"]
+`
+
+// charmhubServer is a stand-in for the Charmhub API, serving icons for
+// the mysql and wordpress charms.
+type charmhubServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	channels map[string]string
+	lookups  map[string]int
+}
+
+func newCharmhubServer() *charmhubServer {
+	srv := &charmhubServer{
+		channels: make(map[string]string),
+		lookups:  make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/charms/info/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v2/charms/info/")
+		srv.mu.Lock()
+		srv.channels[name] = r.URL.Query().Get("channel")
+		srv.lookups[name]++
+		srv.mu.Unlock()
+		var info charmInfo
+		switch name {
+		case "mysql", "wordpress":
+			info.Result.Media = append(info.Result.Media, struct {
+				Type string `json:"type"`
+				URL  string `json:"url"`
+			}{"icon", srv.URL + "/icons/" + name + ".svg"})
+		case "plain":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(info)
+	})
+	mux.HandleFunc("/icons/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/icons/"), ".svg")
+		w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg">` + name + `</svg>`))
+	})
+	srv.Server = httptest.NewServer(mux)
+	return srv
+}
+
+func TestCharmhubFetcher(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	srv := newCharmhubServer()
+	defer srv.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(charmhubBundle))
+	c.Assert(err, qt.IsNil)
+	fetcher := &CharmhubFetcher{
+		URL: srv.URL,
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.DeepEquals, map[string][]byte{
+		"ch:mysql":           []byte(`<svg xmlns="http://www.w3.org/2000/svg">mysql</svg>`),
+		"trusty/wordpress-5": []byte(`<svg xmlns="http://www.w3.org/2000/svg">wordpress</svg>`),
+	})
+	c.Assert(srv.channels, qt.DeepEquals, map[string]string{
+		"mysql":     "8.0/stable",
+		"wordpress": "",
+		"plain":     "",
+	})
+
+	// The fetched icons are used to draw Charmhub charms, without
+	// looking up the charms again.
+	srv.lookups = make(map[string]int)
+	cvs, err := NewFromBundle(ctx, b, fetcher.IconURL, fetcher)
+	c.Assert(err, qt.IsNil)
+	c.Assert(srv.lookups, qt.DeepEquals, map[string]int{
+		"mysql":     1,
+		"wordpress": 1,
+		"plain":     1,
+	})
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), qt.Contains, `<svg xmlns="http://www.w3.org/2000/svg" id="icon-1">mysql</svg>`)
+	c.Assert(buf.String(), qt.Contains, `<title>plain</title>`)
+}
+
+func TestCharmhubFetcherErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	srv := newCharmhubServer()
+	defer srv.Close()
+
+	fetcher := &CharmhubFetcher{
+		URL: srv.URL,
+	}
+	b := &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"missing": {
+				Charm: "ch:missing",
+			},
+		},
+	}
+	_, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "ch:missing": cannot retrieve charm information from .*/v2/charms/info/missing\?fields=result.media: 404 Not Found`)
+
+	b.Applications["missing"].Charm = "ch:Bad_Name"
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot parse charm "ch:Bad_Name": invalid Charmhub charm "ch:Bad_Name": .*`)
+}
+
+func TestCharmhubFetcherOtherCharms(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	srv := newCharmhubServer()
+	defer srv.Close()
+
+	b := &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"bob": {
+				Charm: "cs:~bob/precise/wordpress-1",
+			},
+			"wordpress": {
+				Charm: "cs:trusty/wordpress-5",
+			},
+		},
+	}
+	// Charms that cannot be looked up in Charmhub have no icon by
+	// default.
+	fetcher := &CharmhubFetcher{
+		URL: srv.URL,
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.DeepEquals, map[string][]byte{
+		"trusty/wordpress-5": []byte(`<svg xmlns="http://www.w3.org/2000/svg">wordpress</svg>`),
+	})
+	iconURL, err := fetcher.IconURL(ctx, charm.MustParseURL("cs:~bob/precise/wordpress-1"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconURL, qt.Equals, "")
+
+	// Otherwise FallbackIconURL provides their icons.
+	fetcher = &CharmhubFetcher{
+		URL: srv.URL,
+		FallbackIconURL: func(_ context.Context, charmId *charm.URL) (string, error) {
+			return srv.URL + "/icons/" + charmId.User + ".svg", nil
+		},
+	}
+	icons, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.DeepEquals, map[string][]byte{
+		"~bob/precise/wordpress-1": []byte(`<svg xmlns="http://www.w3.org/2000/svg">bob</svg>`),
+		"trusty/wordpress-5":       []byte(`<svg xmlns="http://www.w3.org/2000/svg">wordpress</svg>`),
+	})
+}
+
+func TestCharmhubFetcherChannels(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	srv := newCharmhubServer()
+	defer srv.Close()
+
+	// The channel of the first application using a charm is used,
+	// whatever the order in which the applications are visited.
+	b := &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"db1": {Charm: "ch:mysql", Channel: "8.0/stable"},
+			"db2": {Charm: "ch:mysql", Channel: "8.0/edge"},
+			"db3": {Charm: "ch:mysql", Channel: "5.7/stable"},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		fetcher := &CharmhubFetcher{
+			URL: srv.URL,
+		}
+		_, err := fetcher.FetchIcons(ctx, b)
+		c.Assert(err, qt.IsNil)
+		c.Assert(srv.channels["mysql"], qt.Equals, "8.0/stable")
+	}
+}
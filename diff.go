@@ -0,0 +1,294 @@
+package jujusvg
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+// DiffStatus describes how an application differs between two bundles.
+type DiffStatus string
+
+const (
+	// DiffAdded is used for applications only in the new bundle.
+	DiffAdded DiffStatus = "added"
+
+	// DiffRemoved is used for applications only in the old bundle.
+	DiffRemoved DiffStatus = "removed"
+
+	// DiffChanged is used for applications in both bundles whose
+	// details differ.
+	DiffChanged DiffStatus = "changed"
+)
+
+// Highlights used to draw the differences between two bundles.
+var (
+	diffAddedHighlight = &highlight{
+		label: "Added",
+		color: "#38b44a",
+	}
+	diffRemovedHighlight = &highlight{
+		label: "Removed",
+		color: "#df382c",
+		faded: true,
+	}
+	diffChangedHighlight = &highlight{
+		label: "Changed",
+		color: "#efb73e",
+	}
+)
+
+// BundleDiff holds the differences between two bundles.
+type BundleDiff struct {
+	// Applications holds an entry for each application that has
+	// been added, removed or changed, indexed by application name.
+	Applications map[string]*ApplicationDiff `json:"applications,omitempty"`
+
+	// AddedRelations and RemovedRelations hold the relations that
+	// are only in the new and old bundles respectively, as specified
+	// in the bundles.
+	AddedRelations   [][]string `json:"added-relations,omitempty"`
+	RemovedRelations [][]string `json:"removed-relations,omitempty"`
+}
+
+// ApplicationDiff holds the differences in a single application between
+// two bundles.
+type ApplicationDiff struct {
+	// Status holds whether the application has been added, removed
+	// or changed.
+	Status DiffStatus `json:"status"`
+
+	// The following fields are set only for changed applications,
+	// and only when the respective detail differs.
+	Charm       *Change           `json:"charm,omitempty"`
+	NumUnits    *Change           `json:"num-units,omitempty"`
+	Constraints *Change           `json:"constraints,omitempty"`
+	Options     map[string]Change `json:"options,omitempty"`
+}
+
+// Change holds the old and new values of a detail that differs between
+// two bundles. A nil value means the detail is not set.
+type Change struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// IsEmpty reports whether there are no differences.
+func (d *BundleDiff) IsEmpty() bool {
+	return len(d.Applications) == 0 && len(d.AddedRelations) == 0 && len(d.RemovedRelations) == 0
+}
+
+// DiffBundles returns the differences between the old and new bundles.
+// Changes to the positions of applications are not reported.
+func DiffBundles(oldb, newb *charm.BundleData) *BundleDiff {
+	diff := &BundleDiff{
+		Applications: make(map[string]*ApplicationDiff),
+	}
+	for name, newApp := range newb.Applications {
+		oldApp, ok := oldb.Applications[name]
+		if !ok {
+			diff.Applications[name] = &ApplicationDiff{
+				Status: DiffAdded,
+			}
+			continue
+		}
+		if appDiff := diffApplications(oldApp, newApp); appDiff != nil {
+			diff.Applications[name] = appDiff
+		}
+	}
+	for name := range oldb.Applications {
+		if _, ok := newb.Applications[name]; !ok {
+			diff.Applications[name] = &ApplicationDiff{
+				Status: DiffRemoved,
+			}
+		}
+	}
+	diff.AddedRelations = relationsNotIn(newb.Relations, oldb.Relations)
+	diff.RemovedRelations = relationsNotIn(oldb.Relations, newb.Relations)
+	sortRelations(diff.AddedRelations)
+	sortRelations(diff.RemovedRelations)
+	return diff
+}
+
+// diffApplications returns the differences between two versions of an
+// application, or nil if there are none.
+func diffApplications(oldApp, newApp *charm.ApplicationSpec) *ApplicationDiff {
+	d := &ApplicationDiff{
+		Status: DiffChanged,
+	}
+	changed := false
+	if oldApp.Charm != newApp.Charm {
+		d.Charm = &Change{oldApp.Charm, newApp.Charm}
+		changed = true
+	}
+	if oldApp.NumUnits != newApp.NumUnits {
+		d.NumUnits = &Change{oldApp.NumUnits, newApp.NumUnits}
+		changed = true
+	}
+	if oldApp.Constraints != newApp.Constraints {
+		d.Constraints = &Change{oldApp.Constraints, newApp.Constraints}
+		changed = true
+	}
+	for key, oldValue := range oldApp.Options {
+		if newValue, ok := newApp.Options[key]; !ok || !reflect.DeepEqual(oldValue, newValue) {
+			if d.Options == nil {
+				d.Options = make(map[string]Change)
+			}
+			d.Options[key] = Change{oldValue, newValue}
+			changed = true
+		}
+	}
+	for key, newValue := range newApp.Options {
+		if _, ok := oldApp.Options[key]; !ok {
+			if d.Options == nil {
+				d.Options = make(map[string]Change)
+			}
+			d.Options[key] = Change{nil, newValue}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return d
+}
+
+// relationsNotIn returns the relations in rels that are not in others,
+// regardless of the order of their endpoints.
+func relationsNotIn(rels, others [][]string) [][]string {
+	existing := make(map[[2]string]bool)
+	for _, rel := range others {
+		if len(rel) == 2 {
+			existing[relationKey(rel)] = true
+		}
+	}
+	var result [][]string
+	for _, rel := range rels {
+		if len(rel) == 2 && !existing[relationKey(rel)] {
+			result = append(result, rel)
+		}
+	}
+	return result
+}
+
+// relationKey returns a key identifying a relation independently of the
+// order of its endpoints.
+func relationKey(rel []string) [2]string {
+	key := [2]string{rel[0], rel[1]}
+	if key[1] < key[0] {
+		key[0], key[1] = key[1], key[0]
+	}
+	return key
+}
+
+// NewFromBundleDiff returns a new Canvas showing the differences between
+// the old and new bundles, along with a summary of those differences.
+// The canvas shows all applications and relations from the new bundle,
+// along with those removed from the old bundle, which are drawn at their
+// old positions. Added, removed and changed items are highlighted and
+// described by a legend. The iconURL and fetcher arguments are used as
+// for NewFromBundle.
+func NewFromBundleDiff(ctx context.Context, oldb, newb *charm.BundleData, iconURL func(context.Context, *charm.URL) (string, error), fetcher IconFetcher) (*Canvas, *BundleDiff, error) {
+	if err := verifyBundle(oldb); err != nil {
+		return nil, nil, errgo.Notef(err, "cannot verify old bundle")
+	}
+	if err := verifyBundle(newb); err != nil {
+		return nil, nil, errgo.Notef(err, "cannot verify new bundle")
+	}
+	diff := DiffBundles(oldb, newb)
+
+	// Draw a bundle that holds everything in either bundle. Unit
+	// placements are not drawn, so they are dropped rather than
+	// reconciling the machines of both bundles.
+	merged := &charm.BundleData{
+		Type:         newb.Type,
+		Series:       newb.Series,
+		Applications: make(map[string]*charm.ApplicationSpec),
+		Saas:         make(map[string]*charm.SaasSpec),
+		Relations:    append([][]string(nil), newb.Relations...),
+	}
+	for _, b := range []*charm.BundleData{oldb, newb} {
+		for name, saas := range b.Saas {
+			merged.Saas[name] = saas
+		}
+	}
+	for name, app := range newb.Applications {
+		merged.Applications[name] = withoutPlacement(app)
+	}
+	for name, appDiff := range diff.Applications {
+		if appDiff.Status == DiffRemoved {
+			merged.Applications[name] = withoutPlacement(oldb.Applications[name])
+		}
+	}
+	merged.Relations = append(merged.Relations, diff.RemovedRelations...)
+	canvas, err := NewFromBundle(ctx, merged, iconURL, fetcher)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+
+	highlights := map[DiffStatus]*highlight{
+		DiffAdded:   diffAddedHighlight,
+		DiffRemoved: diffRemovedHighlight,
+		DiffChanged: diffChangedHighlight,
+	}
+	for _, application := range canvas.applications {
+		if appDiff := diff.Applications[application.name]; appDiff != nil {
+			application.highlight = highlights[appDiff.Status]
+		}
+	}
+	added := make(map[[2]string]bool)
+	for _, rel := range diff.AddedRelations {
+		added[relationKey(rel)] = true
+	}
+	removed := make(map[[2]string]bool)
+	for _, rel := range diff.RemovedRelations {
+		removed[relationKey(rel)] = true
+	}
+	for _, relation := range canvas.relations {
+		key := relationKey([]string{relation.endpointA, relation.endpointB})
+		switch {
+		case added[key]:
+			relation.highlight = diffAddedHighlight
+		case removed[key]:
+			relation.highlight = diffRemovedHighlight
+		}
+	}
+	// List the highlights in a consistent order, omitting any that
+	// are not used.
+	used := make(map[*highlight]bool)
+	for _, application := range canvas.applications {
+		used[application.highlight] = true
+	}
+	for _, relation := range canvas.relations {
+		used[relation.highlight] = true
+	}
+	for _, h := range []*highlight{diffAddedHighlight, diffRemovedHighlight, diffChangedHighlight} {
+		if used[h] {
+			canvas.addHighlight(h)
+		}
+	}
+	return canvas, diff, nil
+}
+
+// sortRelations sorts the given relations so that results are
+// consistent.
+func sortRelations(rels [][]string) {
+	sort.Slice(rels, func(i, j int) bool {
+		ki, kj := relationKey(rels[i]), relationKey(rels[j])
+		if ki[0] != kj[0] {
+			return ki[0] < kj[0]
+		}
+		return ki[1] < kj[1]
+	})
+}
+
+// withoutPlacement returns a copy of the given application with its unit
+// placement directives removed.
+func withoutPlacement(app *charm.ApplicationSpec) *charm.ApplicationSpec {
+	app1 := *app
+	app1.To = nil
+	return &app1
+}
@@ -0,0 +1,169 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+var newBundle = `
+applications:
+  elasticsearch:
+    charm: "cs:~charming-devs/precise/elasticsearch-3"
+    num_units: 2
+    annotations:
+      "gui-x": "490.5"
+      "gui-y": "369.7698359714502"
+    constraints: "mem=2G cpu-cores=1"
+  charmworld:
+    charm: "cs:~juju-jitsu/precise/charmworld-58"
+    num_units: 1
+    expose: true
+    annotations:
+      "gui-x": "813.5"
+      "gui-y": "112.23016402854975"
+    options:
+      charm_import_limit: -1
+      source: "lp:~bac/charmworld/ingest-local-charms"
+      revno: 512
+  haproxy:
+    charm: "cs:precise/haproxy-35"
+    num_units: 1
+    annotations:
+      "gui-x": "1100"
+      "gui-y": "112"
+relations:
+  - - "elasticsearch:essearch"
+    - "charmworld:essearch"
+  - - "haproxy:reverseproxy"
+    - "charmworld:website"
+series: precise
+`
+
+func TestDiffBundles(t *testing.T) {
+	c := qt.New(t)
+
+	oldb, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	newb, err := charm.ReadBundleData(strings.NewReader(newBundle))
+	c.Assert(err, qt.IsNil)
+
+	diff := DiffBundles(oldb, newb)
+	c.Assert(diff.IsEmpty(), qt.Equals, false)
+	c.Assert(diff, qt.DeepEquals, &BundleDiff{
+		Applications: map[string]*ApplicationDiff{
+			"charmworld": {
+				Status: DiffChanged,
+				Options: map[string]Change{
+					"revno": {511, 512},
+				},
+			},
+			"elasticsearch": {
+				Status:   DiffChanged,
+				Charm:    &Change{"cs:~charming-devs/precise/elasticsearch-2", "cs:~charming-devs/precise/elasticsearch-3"},
+				NumUnits: &Change{1, 2},
+			},
+			"haproxy": {
+				Status: DiffAdded,
+			},
+			"mongodb": {
+				Status: DiffRemoved,
+			},
+		},
+		AddedRelations: [][]string{
+			{"haproxy:reverseproxy", "charmworld:website"},
+		},
+		RemovedRelations: [][]string{
+			{"charmworld:database", "mongodb:database"},
+		},
+	})
+
+	diff = DiffBundles(oldb, oldb)
+	c.Assert(diff.IsEmpty(), qt.Equals, true)
+}
+
+func TestNewFromBundleDiff(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	oldb, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	newb, err := charm.ReadBundleData(strings.NewReader(newBundle))
+	c.Assert(err, qt.IsNil)
+
+	cvs, diff, err := NewFromBundleDiff(ctx, oldb, newb, iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.DeepEquals, DiffBundles(oldb, newb))
+
+	// Compare highlights by label, as they hold unexported fields.
+	labels := make(map[string]string)
+	for _, application := range cvs.applications {
+		labels[application.name] = highlightLabel(application.highlight)
+	}
+	c.Assert(labels, qt.DeepEquals, map[string]string{
+		"charmworld":    "Changed",
+		"elasticsearch": "Changed",
+		"haproxy":       "Added",
+		"mongodb":       "Removed",
+	})
+	labels = make(map[string]string)
+	for _, relation := range cvs.relations {
+		labels[relation.name] = highlightLabel(relation.highlight)
+	}
+	c.Assert(labels, qt.DeepEquals, map[string]string{
+		"elasticsearch:essearch charmworld:essearch": "",
+		"haproxy:reverseproxy charmworld:website":    "Added",
+		"charmworld:database mongodb:database":       "Removed",
+	})
+	var legend []string
+	for _, h := range cvs.legend {
+		legend = append(legend, highlightLabel(h))
+	}
+	c.Assert(legend, qt.DeepEquals, []string{"Added", "Removed", "Changed"})
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Logf("%s", buf.String())
+	out := buf.String()
+	c.Assert(out, qt.Contains, `<svg width="791" height="541"`)
+	c.Assert(out, qt.Contains, `<title>mongodb</title>
+<circle cx="90" cy="90" r="90" class="application-block" fill="#f5f5f5" stroke-width="4" stroke="#df382c" stroke-dasharray="8, 4" opacity="0.5" />`)
+	c.Assert(out, qt.Contains, `<g opacity="0.5" >
+<title>charmworld:database mongodb:database</title>
+<line x1="413" y1="90" x2="540" y2="366" stroke="#df382c" stroke-width="1px" stroke-dasharray="143.91, 16" />`)
+	c.Assert(out, qt.Contains, `<g id="legend" transform="translate(0,457)" >
+<rect x="0" y="12" width="14" height="14" fill="#38b44a" />
+<text x="22" y="24" fill="#505050" >Added</text>
+<rect x="0" y="36" width="14" height="14" fill="#df382c" opacity="0.5" />
+<text x="22" y="48" fill="#505050" >Removed</text>
+<rect x="0" y="60" width="14" height="14" fill="#efb73e" />
+<text x="22" y="72" fill="#505050" >Changed</text>
+</g>`)
+}
+
+func TestNewFromBundleDiffBadBundle(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	oldb, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	newb, err := charm.ReadBundleData(strings.NewReader(newBundle))
+	c.Assert(err, qt.IsNil)
+	newb.Relations[0][0] = "evil-unknown-application"
+
+	cvs, diff, err := NewFromBundleDiff(ctx, oldb, newb, iconURL, nil)
+	c.Assert(err, qt.ErrorMatches, "cannot verify new bundle: .*")
+	c.Assert(cvs, qt.IsNil)
+	c.Assert(diff, qt.IsNil)
+}
+
+func highlightLabel(h *highlight) string {
+	if h == nil {
+		return ""
+	}
+	return h.label
+}
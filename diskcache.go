@@ -0,0 +1,199 @@
+package jujusvg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+// diskCacheSuffix is the suffix of the names of icon files in a
+// DiskCacheFetcher directory.
+const diskCacheSuffix = ".icon"
+
+// DiskCacheFetcher is an IconFetcher that caches the icons retrieved by
+// another IconFetcher in a directory on disk, so that they are not
+// retrieved again for later bundles. Icons are keyed by charm path, which
+// includes the charm revision when the bundle specifies one.
+//
+// A DiskCacheFetcher is safe for concurrent use, and several may share
+// the same directory.
+type DiskCacheFetcher struct {
+	// Fetcher is used to retrieve icons that are not in the cache.
+	Fetcher IconFetcher
+
+	// Dir holds the directory in which icons are stored. It is
+	// created if it does not exist.
+	Dir string
+
+	// TTL holds how long an icon is used for after it has been
+	// retrieved. If it is zero, icons do not expire.
+	TTL time.Duration
+
+	// MaxSize holds the maximum total size in bytes of the cached
+	// icons. When it is exceeded, the icons that were retrieved
+	// longest ago are removed first. If it is zero, the size is not limited.
+	MaxSize int64
+
+	// Observer, if not nil, is notified of each icon found in the
+	// cache. Icons that are not found are reported by the observer
+	// of Fetcher, if any.
+	Observer FetchObserver
+
+	// mu guards the removal of icons from Dir.
+	mu sync.Mutex
+}
+
+// FetchIcons implements IconFetcher.FetchIcons by returning cached icons
+// where possible and fetching the remainder with f.Fetcher. If f.Fetcher
+// returns an IconErrors error, the icons it did fetch are cached and
+// returned along with that error.
+func (f *DiskCacheFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	icons := make(map[string][]byte)
+	missing := &charm.BundleData{
+		Applications: make(map[string]*charm.ApplicationSpec),
+	}
+	for name, applicationData := range b.Applications {
+		_, path, err := parseCharm(applicationData.Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse charm %q", applicationData.Charm)
+		}
+		if icons[path] != nil {
+			continue
+		}
+		start := time.Now()
+		if icon := f.get(path); icon != nil {
+			icons[path] = icon
+			observeCacheHit(ctx, f.Observer, path, icon, start)
+			continue
+		}
+		missing.Applications[name] = applicationData
+	}
+	if len(missing.Applications) == 0 {
+		return icons, nil
+	}
+	fetched, fetchErr := f.Fetcher.FetchIcons(ctx, missing)
+	if _, ok := errgo.Cause(fetchErr).(IconErrors); fetchErr != nil && !ok {
+		return nil, errgo.Mask(fetchErr, errgo.Any)
+	}
+	for path, icon := range fetched {
+		if err := f.put(path, icon); err != nil {
+			return nil, errgo.Notef(err, "cannot cache icon for %q", path)
+		}
+		icons[path] = icon
+	}
+	if err := f.evict(); err != nil {
+		return nil, errgo.Notef(err, "cannot remove icons from cache")
+	}
+	return icons, fetchErr
+}
+
+// get returns the cached icon for the given charm path, or nil if there
+// is no icon or it has expired.
+func (f *DiskCacheFetcher) get(path string) []byte {
+	file := f.file(path)
+	if f.TTL > 0 {
+		info, err := os.Stat(file)
+		if err != nil || time.Since(info.ModTime()) > f.TTL {
+			return nil
+		}
+	}
+	icon, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	return icon
+}
+
+// put stores the icon for the given charm path. The icon is written to
+// a temporary file first so that concurrent readers never see a
+// partially written icon.
+func (f *DiskCacheFetcher) put(path string, icon []byte) error {
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return errgo.Mask(err)
+	}
+	tmp, err := ioutil.TempFile(f.Dir, "tmp-")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = tmp.Write(icon)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.file(path))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// evict removes expired icons from the cache, and then the oldest icons
+// until the cache is no larger than f.MaxSize.
+func (f *DiskCacheFetcher) evict() error {
+	if f.TTL <= 0 && f.MaxSize <= 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	infos, err := ioutil.ReadDir(f.Dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var size int64
+	icons := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), diskCacheSuffix) {
+			continue
+		}
+		if f.TTL > 0 && time.Since(info.ModTime()) > f.TTL {
+			if err := f.remove(info.Name()); err != nil {
+				return errgo.Mask(err)
+			}
+			continue
+		}
+		size += info.Size()
+		icons = append(icons, info)
+	}
+	if f.MaxSize <= 0 {
+		return nil
+	}
+	sort.SliceStable(icons, func(i, j int) bool {
+		return icons[i].ModTime().Before(icons[j].ModTime())
+	})
+	for i := 0; size > f.MaxSize && i < len(icons); i++ {
+		if err := f.remove(icons[i].Name()); err != nil {
+			return errgo.Mask(err)
+		}
+		size -= icons[i].Size()
+	}
+	return nil
+}
+
+// remove removes the named file from the cache directory. It is not an
+// error if the file has already been removed by another user of the
+// directory.
+func (f *DiskCacheFetcher) remove(name string) error {
+	if err := os.Remove(filepath.Join(f.Dir, name)); err != nil && !os.IsNotExist(err) {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// file returns the name of the file holding the icon for the given charm
+// path. Charm paths contain slashes, so a hash is used instead.
+func (f *DiskCacheFetcher) file(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(f.Dir, hex.EncodeToString(sum[:])+diskCacheSuffix)
+}
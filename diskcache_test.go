@@ -0,0 +1,208 @@
+package jujusvg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+func TestDiskCacheFetcher(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	expected := map[string][]byte{
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>~charming-devs/precise/elasticsearch-2</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>~juju-jitsu/precise/charmworld-58</svg>"),
+		"precise/mongodb-21":                     []byte("<svg>precise/mongodb-21</svg>"),
+	}
+
+	dir := filepath.Join(c.Mkdir(), "icons")
+	underlying := &pathFetcher{}
+	fetcher := &DiskCacheFetcher{
+		Fetcher: underlying,
+		Dir:     dir,
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.DeepEquals, expected)
+	c.Assert(underlying.fetched, qt.DeepEquals, map[string]int{
+		"~charming-devs/precise/elasticsearch-2": 1,
+		"~juju-jitsu/precise/charmworld-58":      1,
+		"precise/mongodb-21":                     1,
+	})
+
+	// A second fetcher using the same directory finds the cached
+	// icons, and only fetches new ones.
+	b.Applications["haproxy"] = &charm.ApplicationSpec{
+		Charm: "cs:precise/haproxy-35",
+	}
+	underlying = &pathFetcher{}
+	fetcher = &DiskCacheFetcher{
+		Fetcher: underlying,
+		Dir:     dir,
+	}
+	icons, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons["precise/mongodb-21"], qt.DeepEquals, expected["precise/mongodb-21"])
+	c.Assert(icons["precise/haproxy-35"], qt.DeepEquals, []byte("<svg>precise/haproxy-35</svg>"))
+	c.Assert(underlying.fetched, qt.DeepEquals, map[string]int{
+		"precise/haproxy-35": 1,
+	})
+	c.Assert(cacheFiles(c, dir), qt.Equals, 4)
+}
+
+func TestDiskCacheFetcherTTL(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	underlying := &pathFetcher{}
+	fetcher := &DiskCacheFetcher{
+		Fetcher: underlying,
+		Dir:     c.Mkdir(),
+		TTL:     time.Hour,
+	}
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+
+	// Age the mongodb icon so that it has expired.
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(fetcher.file("precise/mongodb-21"), old, old)
+	c.Assert(err, qt.IsNil)
+
+	underlying.fetched = nil
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.HasLen, 3)
+	c.Assert(underlying.fetched, qt.DeepEquals, map[string]int{
+		"precise/mongodb-21": 1,
+	})
+}
+
+func TestDiskCacheFetcherMaxSize(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	dir := c.Mkdir()
+	underlying := &pathFetcher{}
+	fetcher := &DiskCacheFetcher{
+		Fetcher: underlying,
+		Dir:     dir,
+		// Room for two icons of the form <svg>precise/xxx-1</svg>.
+		MaxSize: 2 * int64(len("<svg>precise/xxx-1</svg>")),
+	}
+	for i, name := range []string{"aaa", "bbb", "ccc"} {
+		_, err := fetcher.FetchIcons(ctx, &charm.BundleData{
+			Applications: map[string]*charm.ApplicationSpec{
+				name: {Charm: "cs:precise/" + name + "-1"},
+			},
+		})
+		c.Assert(err, qt.IsNil)
+		// Make sure the icons have distinct ages.
+		t := time.Now().Add(time.Duration(i-3) * time.Minute)
+		err = os.Chtimes(fetcher.file("precise/"+name+"-1"), t, t)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(cacheFiles(c, dir), qt.Equals, 2)
+	c.Assert(fetcher.get("precise/aaa-1"), qt.IsNil)
+	c.Assert(fetcher.get("precise/bbb-1"), qt.Not(qt.IsNil))
+	c.Assert(fetcher.get("precise/ccc-1"), qt.Not(qt.IsNil))
+}
+
+func TestDiskCacheFetcherConcurrent(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	fetcher := &DiskCacheFetcher{
+		Fetcher: &pathFetcher{},
+		Dir:     c.Mkdir(),
+		MaxSize: 1000,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			icons, err := fetcher.FetchIcons(ctx, b)
+			c.Check(err, qt.IsNil)
+			c.Check(icons, qt.HasLen, 3)
+		}()
+	}
+	wg.Wait()
+	c.Assert(cacheFiles(c, fetcher.Dir), qt.Equals, 3)
+}
+
+func TestDiskCacheFetcherError(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	underlying := errFetcher("bad wolf")
+	fetcher := &DiskCacheFetcher{
+		Fetcher: &underlying,
+		Dir:     c.Mkdir(),
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, "bad wolf")
+	c.Assert(icons, qt.IsNil)
+}
+
+// pathFetcher is an IconFetcher that returns an icon holding the charm
+// path for each charm, and records how many times each was fetched.
+type pathFetcher struct {
+	mu      sync.Mutex
+	fetched map[string]int
+}
+
+func (f *pathFetcher) FetchIcons(_ context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fetched == nil {
+		f.fetched = make(map[string]int)
+	}
+	icons := make(map[string][]byte)
+	for _, app := range b.Applications {
+		_, path, err := parseCharm(app.Charm)
+		if err != nil {
+			return nil, err
+		}
+		if icons[path] == nil {
+			icons[path] = []byte(fmt.Sprintf("<svg>%s</svg>", path))
+			f.fetched[path]++
+		}
+	}
+	return icons, nil
+}
+
+// cacheFiles returns the number of icons in the given cache directory.
+func cacheFiles(c *qt.C, dir string) int {
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, qt.IsNil)
+	n := 0
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), diskCacheSuffix) {
+			n++
+		}
+	}
+	return n
+}
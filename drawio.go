@@ -0,0 +1,158 @@
+package jujusvg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// drawIOEdgeStyle holds the mxGraph style used for relation connectors.
+const drawIOEdgeStyle = "endArrow=none;html=1;strokeColor=" + relationColor + ";strokeWidth=1;"
+
+// mxFile is the root element of a draw.io (diagrams.net) file.
+type mxFile struct {
+	XMLName xml.Name  `xml:"mxfile"`
+	Host    string    `xml:"host,attr"`
+	Diagram mxDiagram `xml:"diagram"`
+}
+
+// mxDiagram holds a single page of a draw.io file.
+type mxDiagram struct {
+	ID    string       `xml:"id,attr"`
+	Name  string       `xml:"name,attr"`
+	Model mxGraphModel `xml:"mxGraphModel"`
+}
+
+// mxGraphModel holds the cells making up a diagram.
+type mxGraphModel struct {
+	PageWidth  int      `xml:"pageWidth,attr"`
+	PageHeight int      `xml:"pageHeight,attr"`
+	Cells      []mxCell `xml:"root>mxCell"`
+}
+
+// mxCell holds either a shape (vertex) or a connector (edge).
+type mxCell struct {
+	ID       string      `xml:"id,attr"`
+	Value    string      `xml:"value,attr,omitempty"`
+	Style    string      `xml:"style,attr,omitempty"`
+	Parent   string      `xml:"parent,attr,omitempty"`
+	Vertex   string      `xml:"vertex,attr,omitempty"`
+	Edge     string      `xml:"edge,attr,omitempty"`
+	Source   string      `xml:"source,attr,omitempty"`
+	Target   string      `xml:"target,attr,omitempty"`
+	Geometry *mxGeometry `xml:"mxGeometry,omitempty"`
+}
+
+// mxGeometry holds the position of a cell.
+type mxGeometry struct {
+	X        int    `xml:"x,attr,omitempty"`
+	Y        int    `xml:"y,attr,omitempty"`
+	Width    int    `xml:"width,attr,omitempty"`
+	Height   int    `xml:"height,attr,omitempty"`
+	Relative string `xml:"relative,attr,omitempty"`
+	As       string `xml:"as,attr"`
+}
+
+// MarshalDrawIO renders the canvas to the given io.Writer as a draw.io
+// (diagrams.net) file. Each application becomes a shape showing its
+// charm icon, embedded if the icon contents were fetched and linked by
+// URL otherwise, and each relation becomes a connector bound to the
+// shapes of both applications, so that the result can be edited
+// further.
+func (c *Canvas) MarshalDrawIO(w io.Writer) error {
+	width, height := c.layout()
+	cells := []mxCell{{
+		ID: "0",
+	}, {
+		ID:     "1",
+		Parent: "0",
+	}}
+	for _, application := range c.applications {
+		cells = append(cells, mxCell{
+			ID:     drawIOApplicationID(application),
+			Value:  application.name,
+			Style:  application.drawIOStyle(c.iconOptions()),
+			Parent: "1",
+			Vertex: "1",
+			Geometry: &mxGeometry{
+				X:      application.point.X + applicationBlockSize/2 - iconSize/2,
+				Y:      application.point.Y + applicationBlockSize/2 - iconSize/2,
+				Width:  iconSize,
+				Height: iconSize,
+				As:     "geometry",
+			},
+		})
+	}
+	for i, relation := range c.relations {
+		cells = append(cells, mxCell{
+			ID:     fmt.Sprintf("relation-%d", i),
+			Style:  drawIOEdgeStyle,
+			Parent: "1",
+			Edge:   "1",
+			Source: drawIOApplicationID(relation.applicationA),
+			Target: drawIOApplicationID(relation.applicationB),
+			Geometry: &mxGeometry{
+				Relative: "1",
+				As:       "geometry",
+			},
+		})
+	}
+	f := mxFile{
+		Host: "jujusvg",
+		Diagram: mxDiagram{
+			ID:   "bundle",
+			Name: "bundle",
+			Model: mxGraphModel{
+				PageWidth:  width,
+				PageHeight: height,
+				Cells:      cells,
+			},
+		},
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return errgo.Mask(err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(f); err != nil {
+		return errgo.Notef(err, "cannot encode draw.io diagram")
+	}
+	return nil
+}
+
+// drawIOApplicationID returns the id of the cell for the given
+// application.
+func drawIOApplicationID(s *application) string {
+	return "application-" + s.name
+}
+
+// drawIOStyle returns the mxGraph style used for the application's
+// shape. If the application has icon contents that are a valid SVG
+// within the limits in the given options, they are embedded as a data
+// URI; otherwise the icon URL is used, with any semicolons escaped so
+// that they cannot end the image entry.
+func (s *application) drawIOStyle(opts iconOptions) string {
+	image := strings.Replace(s.iconUrl, ";", "%3B", -1)
+	if len(s.iconSrc) > 0 {
+		opts.trustedURL = s.iconUrl
+		var buf bytes.Buffer
+		if _, err := processIcon(bytes.NewReader(s.iconSrc), &buf, "icon", opts); err == nil {
+			// draw.io uses a semicolon to separate style entries,
+			// so the data URI omits the usual ";base64" marker.
+			image = "data:image/svg+xml," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+	style := "shape=image;html=1;imageAspect=1;aspect=fixed;" +
+		"verticalLabelPosition=bottom;verticalAlign=top;" +
+		"fontColor=" + fontColor + ";"
+	if image == "" {
+		// SAAS entries may have no icon at all.
+		return style
+	}
+	return style + "image=" + image + ";"
+}
@@ -0,0 +1,136 @@
+package jujusvg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"image"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestMarshalDrawIO(t *testing.T) {
+	c := qt.New(t)
+
+	canvas := Canvas{}
+	applicationA := &application{
+		name:      "application-a",
+		charmPath: "trusty/svc-a",
+		point: image.Point{
+			X: 0,
+			Y: 0,
+		},
+		iconSrc: []byte(`
+			<svg xmlns="http://www.w3.org/2000/svg" class="blah">
+				<circle cx="20" cy="20" r="20" style="fill:#000" />
+			</svg>`),
+	}
+	applicationB := &application{
+		name:    "application-b",
+		iconUrl: "http://0.1.2.3/svc-b.svg",
+		point: image.Point{
+			X: 100,
+			Y: 100,
+		},
+	}
+	canvas.addApplication(applicationA)
+	canvas.addApplication(applicationB)
+	canvas.addRelation(&applicationRelation{
+		name:         "relation",
+		applicationA: applicationA,
+		applicationB: applicationB,
+	})
+	var buf bytes.Buffer
+	err := canvas.MarshalDrawIO(&buf)
+	c.Assert(err, qt.IsNil)
+	c.Logf("%s", buf.Bytes())
+
+	// The embedded icon is checked separately below.
+	var f mxFile
+	err = xml.Unmarshal(buf.Bytes(), &f)
+	c.Assert(err, qt.IsNil)
+	cells := f.Diagram.Model.Cells
+	c.Assert(cells, qt.HasLen, 5)
+	style := cells[2].Style
+	i := strings.Index(style, "image=data:image/svg+xml,")
+	c.Assert(i, qt.Not(qt.Equals), -1)
+	data := strings.TrimSuffix(style[i+len("image=data:image/svg+xml,"):], ";")
+	icon, err := base64.StdEncoding.DecodeString(data)
+	c.Assert(err, qt.IsNil)
+	assertXMLEqual(c, icon, []byte(`
+<svg xmlns="http://www.w3.org/2000/svg" class="blah" id="icon">
+	<circle cx="20" cy="20" r="20" style="fill:#000"></circle>
+</svg>`))
+	cells[2].Style = style[:i] + "image=ICON;"
+
+	c.Assert(f, qt.DeepEquals, mxFile{
+		XMLName: xml.Name{Local: "mxfile"},
+		Host:    "jujusvg",
+		Diagram: mxDiagram{
+			ID:   "bundle",
+			Name: "bundle",
+			Model: mxGraphModel{
+				PageWidth:  281,
+				PageHeight: 281,
+				Cells: []mxCell{{
+					ID: "0",
+				}, {
+					ID:     "1",
+					Parent: "0",
+				}, {
+					ID:     "application-application-a",
+					Value:  "application-a",
+					Style:  "shape=image;html=1;imageAspect=1;aspect=fixed;verticalLabelPosition=bottom;verticalAlign=top;fontColor=#505050;image=ICON;",
+					Parent: "1",
+					Vertex: "1",
+					Geometry: &mxGeometry{
+						X:      42,
+						Y:      42,
+						Width:  96,
+						Height: 96,
+						As:     "geometry",
+					},
+				}, {
+					ID:     "application-application-b",
+					Value:  "application-b",
+					Style:  "shape=image;html=1;imageAspect=1;aspect=fixed;verticalLabelPosition=bottom;verticalAlign=top;fontColor=#505050;image=http://0.1.2.3/svc-b.svg;",
+					Parent: "1",
+					Vertex: "1",
+					Geometry: &mxGeometry{
+						X:      142,
+						Y:      142,
+						Width:  96,
+						Height: 96,
+						As:     "geometry",
+					},
+				}, {
+					ID:     "relation-0",
+					Style:  "endArrow=none;html=1;strokeColor=#a7a7a7;strokeWidth=1;",
+					Parent: "1",
+					Edge:   "1",
+					Source: "application-application-a",
+					Target: "application-application-b",
+					Geometry: &mxGeometry{
+						Relative: "1",
+						As:       "geometry",
+					},
+				}},
+			},
+		},
+	})
+}
+
+func TestDrawIOStyleIconURL(t *testing.T) {
+	c := qt.New(t)
+
+	// Semicolons in icon URLs cannot add entries to the style.
+	s := &application{
+		name:    "application-a",
+		iconUrl: "http://0.1.2.3/icon.svg?a=1;fillColor=red",
+	}
+	style := s.drawIOStyle(iconOptions{})
+	c.Assert(style, qt.Not(qt.Contains), ";fillColor=")
+	c.Assert(strings.HasSuffix(style, ";image=http://0.1.2.3/icon.svg?a=1%3BfillColor=red;"), qt.IsTrue, qt.Commentf("%s", style))
+}
@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"io/ioutil"
 	"log"
 	"os"
@@ -16,21 +17,21 @@ import (
 	"github.com/juju/jujusvg/v4"
 )
 
-// iconURL takes a reference to a charm and returns the URL for that charm's icon.
-// In this case, we're using the api.jujucharms.com API to provide the icon's URL.
-func iconURL(ctx context.Context, ref *charm.URL) (string, error) {
-	return "https://api.jujucharms.com/charmstore/v4/" + ref.Path() + "/icon.svg", nil
-}
+var (
+	writePack = flag.String("write-pack", "", "write the bundle's icons to the given icon pack instead of drawing it")
+	pack      = flag.String("pack", "", "draw the bundle offline using icons from the given icon pack")
+)
 
 func main() {
-	if len(os.Args) != 2 {
+	flag.Parse()
+	if flag.NArg() != 1 {
 		log.Fatalf("Please provide the name of a bundle file as the first argument")
 	}
 
 	ctx := context.Background()
 
 	// First, we need to read our bundle data into a []byte
-	bundle_data, err := ioutil.ReadFile(os.Args[1])
+	bundle_data, err := ioutil.ReadFile(flag.Arg(0))
 	if err != nil {
 		log.Fatalf("Error reading bundle: %s\n", err)
 	}
@@ -42,9 +43,39 @@ func main() {
 		log.Fatalf("Error parsing bundle: %s\n", err)
 	}
 
-	fetcher := &jujusvg.HTTPFetcher{
-		IconURL: iconURL,
+	// The fetcher looks up the charms' icons in Charmhub. Charms that
+	// Charmhub does not hold, such as those belonging to a user in
+	// the old charm store, are drawn without an icon. IconURL reuses
+	// the lookups made when fetching the icons.
+	charmhub := &jujusvg.CharmhubFetcher{}
+	iconURL := charmhub.IconURL
+	var fetcher jujusvg.IconFetcher = charmhub
+
+	if *writePack != "" {
+		// Save the icons so that the bundle can be drawn offline later.
+		f, err := os.Create(*writePack)
+		if err != nil {
+			log.Fatalf("Error creating icon pack: %s\n", err)
+		}
+		if err := jujusvg.WriteIconPack(ctx, f, fetcher, bundle); err != nil {
+			log.Fatalf("Error writing icon pack: %s\n", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("Error writing icon pack: %s\n", err)
+		}
+		return
 	}
+	if *pack != "" {
+		// Use only the icons in the pack, without contacting Charmhub.
+		fetcher, err = jujusvg.OpenIconPack(*pack)
+		if err != nil {
+			log.Fatalf("Error opening icon pack: %s\n", err)
+		}
+		iconURL = func(context.Context, *charm.URL) (string, error) {
+			return "", nil
+		}
+	}
+
 	// Next, build a canvas of the bundle.  This is a simplified version of a charm.Bundle
 	// that contains just the position information and charm icon URLs necessary to build
 	// the SVG representation of the bundle
@@ -0,0 +1,158 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujusvg/v4/assets"
+)
+
+// FallbackIcon specifies what to draw for an application whose icon
+// could not be fetched or is not valid.
+type FallbackIcon int
+
+const (
+	// FallbackGlyph draws a generic charm glyph.
+	FallbackGlyph FallbackIcon = iota
+
+	// FallbackMonogram draws the initials of the charm name on a
+	// background whose colour is derived from the name.
+	FallbackMonogram
+)
+
+// monogramColors holds the background colours used for monograms.
+var monogramColors = []string{
+	"#e95420",
+	"#77216f",
+	"#0e8420",
+	"#335280",
+	"#c7162b",
+	"#f99b11",
+	"#007aa6",
+	"#5e2750",
+}
+
+// NewFromBundleWithFallback is like NewFromBundle, except that failing
+// to fetch the icon for a charm, or fetching an icon that is not a valid
+// SVG or that exceeds DefaultIconLimits, does not cause an error. Such
+// icons are replaced as specified by fallback, and the errors are
+// returned keyed by charm path so that the caller can report them. To
+// fetch as many icons as possible, fetcher should return the icons it
+// could fetch along with an IconErrors error, as HTTPFetcher does when
+// its Partial field is set; any other error from fetcher causes all
+// icons to be replaced.
+func NewFromBundleWithFallback(ctx context.Context, b *charm.BundleData, iconURL func(context.Context, *charm.URL) (string, error), fetcher IconFetcher, fallback FallbackIcon) (*Canvas, IconErrors, error) {
+	if fetcher == nil {
+		fetcher = &LinkFetcher{
+			IconURL: iconURL,
+		}
+	}
+	icons, iconErrs, err := fetchIconsWithFallback(ctx, b, fetcher, fallback)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	canvas, err := NewFromBundle(ctx, b, iconURL, IconMap(icons))
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	return canvas, iconErrs, nil
+}
+
+// fetchIconsWithFallback fetches the icons for b with fetcher, replacing
+// any that cannot be fetched or are not valid with fallback icons.
+func fetchIconsWithFallback(ctx context.Context, b *charm.BundleData, fetcher IconFetcher, fallback FallbackIcon) (map[string][]byte, IconErrors, error) {
+	fetched, err := fetcher.FetchIcons(ctx, b)
+	iconErrs := make(IconErrors)
+	var fetchErr error
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, errgo.Mask(err, errgo.Any)
+		}
+		if errs, ok := errgo.Cause(err).(IconErrors); ok {
+			for path, err := range errs {
+				iconErrs[path] = err
+			}
+		} else {
+			fetched, fetchErr = nil, err
+		}
+	}
+	icons := make(map[string][]byte)
+	for _, applicationData := range b.Applications {
+		charmId, path, err := parseCharm(applicationData.Charm)
+		if err != nil {
+			return nil, nil, errgo.Notef(err, "cannot parse charm %q", applicationData.Charm)
+		}
+		if icons[path] != nil {
+			continue
+		}
+		if fetchErr != nil {
+			iconErrs[path] = fetchErr
+		}
+		icon := fetched[path]
+		if iconErrs[path] == nil && icon != nil {
+			// Raster icons are converted as by NewFromBundle
+			// before they are checked.
+			if svg, err := svgIcon(icon, "", false, DefaultIconLimits.MaxPixels); err == nil {
+				icon = svg
+			}
+			if _, err := processIcon(bytes.NewReader(icon), ioutil.Discard, "icon", iconOptions{
+				limits: DefaultIconLimits,
+			}); err != nil {
+				iconErrs[path] = errgo.Notef(err, "invalid icon")
+			}
+		}
+		if iconErrs[path] != nil {
+			icon = fallbackIcon(charmId, fallback)
+		}
+		if icon != nil {
+			icons[path] = icon
+		}
+	}
+	if len(iconErrs) == 0 {
+		iconErrs = nil
+	}
+	return icons, iconErrs, nil
+}
+
+// fallbackIcon returns the icon to use for the given charm when its own
+// icon is not available.
+func fallbackIcon(charmId *charm.URL, fallback FallbackIcon) []byte {
+	if fallback != FallbackMonogram {
+		return []byte(assets.CharmIconFallback)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(charmId.Name))
+	color := monogramColors[h.Sum32()%uint32(len(monogramColors))]
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="96" height="96" viewBox="0 0 96 96">`+
+		`<circle cx="48" cy="48" r="48" fill="%s"/>`+
+		`<text x="48" y="48" dy="0.35em" text-anchor="middle" font-family="Ubuntu, sans-serif" font-size="40" fill="#fff">%s</text>`+
+		`</svg>`, color, escapeString(monogram(charmId.Name))))
+}
+
+// monogram returns the initials of the given charm name: the first
+// letters of its first two words, or its first letter if it has only
+// one word.
+func monogram(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var initials []rune
+	for _, word := range words {
+		if len(initials) == 2 {
+			break
+		}
+		initials = append(initials, unicode.ToUpper([]rune(word)[0]))
+	}
+	if len(initials) == 0 {
+		return "?"
+	}
+	return string(initials)
+}
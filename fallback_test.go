@@ -0,0 +1,193 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+func TestNewFromBundleWithFallback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "mongodb"):
+			http.Error(w, "bad wolf", http.StatusNotFound)
+		case strings.Contains(r.URL.Path, "charmworld"):
+			fmt.Fprint(w, "not an svg")
+		default:
+			fmt.Fprint(w, `<svg xmlns="http://www.w3.org/2000/svg"><rect id="es"/></svg>`)
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	fetcher := &HTTPFetcher{
+		IconURL: func(_ context.Context, ref *charm.URL) (string, error) {
+			return ts.URL + "/" + ref.Path() + ".svg", nil
+		},
+		Partial: true,
+	}
+	cvs, iconErrs, err := NewFromBundleWithFallback(ctx, b, iconURL, fetcher, FallbackGlyph)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconErrs, qt.HasLen, 2)
+	c.Assert(iconErrs["precise/mongodb-21"], qt.ErrorMatches, `cannot retrieve icon from .*/precise/mongodb-21\.svg: 404 Not Found`)
+	c.Assert(iconErrs["~juju-jitsu/precise/charmworld-58"], qt.ErrorMatches, `invalid icon: icon does not appear to be a valid SVG`)
+	c.Assert(iconErrs, qt.ErrorMatches, `cannot fetch icon for "precise/mongodb-21": .* \(and 1 more\)`)
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	out := buf.String()
+	c.Assert(out, qt.Matches, `(?s).*<rect id="icon-\d-es"></rect>.*`)
+	c.Assert(strings.Count(out, `fill="#d8d8d8"`), qt.Equals, 2)
+	c.Assert(out, qt.Not(qt.Contains), `<image`)
+}
+
+func TestNewFromBundleWithFallbackRaster(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	svgIcon := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect/></svg>`)
+	cvs, iconErrs, err := NewFromBundleWithFallback(ctx, b, iconURL, IconMap{
+		"~juju-jitsu/precise/charmworld-58":      svgIcon,
+		"~charming-devs/precise/elasticsearch-2": svgIcon,
+		"precise/mongodb-21":                     rasterIcon(c, 4, 4),
+	}, FallbackGlyph)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconErrs, qt.HasLen, 0)
+
+	// The raster icon is embedded rather than replaced.
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	out := buf.String()
+	c.Assert(out, qt.Contains, `href="data:image/png;base64,`)
+	c.Assert(out, qt.Not(qt.Contains), `fill="#d8d8d8"`)
+}
+
+func TestNewFromBundleWithFallbackMonogram(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	// An error from a fetcher that does not return IconErrors
+	// causes every icon to be replaced.
+	fetcher := errFetcher("bad wolf")
+	cvs, iconErrs, err := NewFromBundleWithFallback(ctx, b, iconURL, &fetcher, FallbackMonogram)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconErrs, qt.HasLen, 3)
+	for path, err := range iconErrs {
+		c.Assert(err, qt.ErrorMatches, "bad wolf", qt.Commentf("%s", path))
+	}
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	out := buf.String()
+	for _, initials := range []string{"M", "E", "C"} {
+		c.Assert(out, qt.Contains, `fill="#fff">`+initials+`</text>`)
+	}
+}
+
+func TestNewFromBundleWithFallbackNoErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	cvs, iconErrs, err := NewFromBundleWithFallback(ctx, b, iconURL, nil, FallbackGlyph)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconErrs, qt.HasLen, 0)
+
+	// The result is the same as without fallback icons.
+	expected, err := NewFromBundle(ctx, b, iconURL, nil)
+	c.Assert(err, qt.IsNil)
+	var buf, expectedBuf bytes.Buffer
+	cvs.Marshal(&buf)
+	expected.Marshal(&expectedBuf)
+	c.Assert(buf.String(), qt.Equals, expectedBuf.String())
+
+	// Cancellation is still an error.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	fetcher := &HTTPFetcher{
+		IconURL: iconURL,
+		Partial: true,
+	}
+	cvs, iconErrs, err = NewFromBundleWithFallback(ctx, b, iconURL, fetcher, FallbackGlyph)
+	c.Assert(err, qt.ErrorMatches, "cannot fetch icons: context canceled")
+	c.Assert(cvs, qt.IsNil)
+	c.Assert(iconErrs, qt.HasLen, 0)
+}
+
+func TestMemoryCacheFetcherPartial(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	underlying := &partialFetcher{
+		Fetcher: &pathFetcher{},
+		fail:    "precise/mongodb-21",
+	}
+	fetcher := &MemoryCacheFetcher{
+		Fetcher: underlying,
+	}
+	for i := 0; i < 2; i++ {
+		icons, err := fetcher.FetchIcons(ctx, b)
+		c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "precise/mongodb-21": bad wolf`)
+		c.Assert(icons, qt.HasLen, 2)
+	}
+	// Only the failed icon is fetched again.
+	c.Assert(fetcher.Stats(), qt.DeepEquals, CacheStats{
+		Hits:   2,
+		Misses: 4,
+		Icons:  2,
+	})
+}
+
+func TestMonogram(t *testing.T) {
+	c := qt.New(t)
+
+	for name, expected := range map[string]string{
+		"mongodb":                   "M",
+		"elasticsearch":             "E",
+		"kubernetes-control-plane":  "KC",
+		"":                          "?",
+		"0-ubuntu":                  "0U",
+		"openstack-dashboard-proxy": "OD",
+	} {
+		c.Assert(monogram(name), qt.Equals, expected, qt.Commentf("%q", name))
+	}
+}
+
+// partialFetcher is an IconFetcher that fails to fetch one icon,
+// returning the others along with an IconErrors error.
+type partialFetcher struct {
+	Fetcher IconFetcher
+	fail    string
+}
+
+func (f *partialFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	icons, err := f.Fetcher.FetchIcons(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := icons[f.fail]; !ok {
+		return icons, nil
+	}
+	delete(icons, f.fail)
+	return icons, IconErrors{
+		f.fail: fmt.Errorf("bad wolf"),
+	}
+}
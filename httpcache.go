@@ -0,0 +1,69 @@
+package jujusvg
+
+import "sync"
+
+// An HTTPCache stores icons retrieved by an HTTPFetcher, along with the
+// validators sent by the server, so that later fetches can ask the
+// server whether the icon has changed rather than downloading it again.
+// Implementations must be safe for concurrent use.
+type HTTPCache interface {
+	// Get returns the icon stored for the given URL, or nil if
+	// there is none.
+	Get(url string) *CachedIcon
+
+	// Put stores the icon for the given URL.
+	Put(url string, icon *CachedIcon)
+}
+
+// CachedIcon holds an icon stored in an HTTPCache.
+type CachedIcon struct {
+	// Data holds the icon itself.
+	Data []byte
+
+	// ETag and LastModified hold the values of the ETag and
+	// Last-Modified headers of the response that held the icon.
+	ETag         string
+	LastModified string
+}
+
+// MemoryHTTPCache is an HTTPCache that holds the most recently used
+// icons in memory.
+type MemoryHTTPCache struct {
+	// MaxIcons holds the maximum number of icons to keep. If it is
+	// not positive, 100 will be used.
+	MaxIcons int
+
+	// mu guards icons.
+	mu sync.Mutex
+
+	// icons holds the cached icons, keyed by URL.
+	icons *lruCache
+}
+
+// Get implements HTTPCache.Get.
+func (c *MemoryHTTPCache) Get(url string) *CachedIcon {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.icons == nil {
+		return nil
+	}
+	icon, ok := c.icons.get(url)
+	if !ok {
+		return nil
+	}
+	return icon.(*CachedIcon)
+}
+
+// Put implements HTTPCache.Put.
+func (c *MemoryHTTPCache) Put(url string, icon *CachedIcon) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.icons == nil {
+		maxIcons := c.MaxIcons
+		if maxIcons <= 0 {
+			maxIcons = 100
+		}
+		c.icons = newLRUCache(maxIcons)
+	}
+	c.icons.add(url, icon)
+}
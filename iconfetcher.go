@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/juju/charm/v7"
 	"github.com/juju/utils/parallel"
@@ -37,11 +42,10 @@ func (l *LinkFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[
 	// Build the map of icons.
 	icons := make(map[string][]byte)
 	for _, applicationData := range b.Applications {
-		charmId, err := charm.ParseURL(applicationData.Charm)
+		charmId, path, err := parseCharm(applicationData.Charm)
 		if err != nil {
 			return nil, errgo.Notef(err, "cannot parse charm %q", applicationData.Charm)
 		}
-		path := charmId.Path()
 
 		// Don't duplicate icons in the map.
 		if !alreadyFetched[path] {
@@ -59,6 +63,16 @@ func (l *LinkFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[
 	return icons, nil
 }
 
+// IconMap is an IconFetcher that returns icons that have already been
+// fetched, keyed by charm path, such as those returned by
+// FetchIconsForSources.
+type IconMap map[string][]byte
+
+// FetchIcons implements IconFetcher.FetchIcons.
+func (f IconMap) FetchIcons(context.Context, *charm.BundleData) (map[string][]byte, error) {
+	return f, nil
+}
+
 // Wrap around xml.EscapeText to make it more string-friendly.
 func escapeString(s string) string {
 	var buf bytes.Buffer
@@ -77,15 +91,67 @@ type HTTPFetcher struct {
 	Concurrency int
 
 	// IconURL returns the URL from which to fetch the given entity's icon SVG.
+	// If it returns an empty URL, the charm is taken to have no icon.
 	IconURL func(context.Context, *charm.URL) (string, error)
 
 	// Client specifies what HTTP client to use; if it is not provided,
 	// http.DefaultClient will be used.
 	Client *http.Client
+
+	// Timeout specifies the maximum time to spend fetching each icon,
+	// including the call to IconURL and any retries.  If it is zero, the
+	// time is limited only by the context passed to FetchIcons.
+	Timeout time.Duration
+
+	// Retries specifies how many more times to try fetching an icon
+	// after a connection error or a 429 or 5xx response.
+	Retries int
+
+	// RetryDelay specifies the delay before the first retry.  It is
+	// doubled for each subsequent retry, and a random jitter of up to
+	// half the delay is subtracted.  If it is not positive, 100ms will
+	// be used.
+	RetryDelay time.Duration
+
+	// MaxRetryDelay specifies the maximum delay between retries.  If a
+	// response has a Retry-After header asking for a longer delay, the
+	// fetch fails rather than retrying early.  If it is not positive,
+	// 10s will be used.
+	MaxRetryDelay time.Duration
+
+	// Cache, if non-nil, is used to store fetched icons along with
+	// their ETag and Last-Modified headers.  When an icon is fetched
+	// again, these are used to make a conditional request so that
+	// unchanged icons are not downloaded again.
+	Cache HTTPCache
+
+	// MaxIconBytes specifies the maximum size of an icon.  Larger
+	// icons are not downloaded in full, and cause an error.  If it is
+	// zero, DefaultIconLimits.MaxBytes will be used; if it is negative,
+	// the size is not limited.
+	MaxIconBytes int64
+
+	// Partial specifies that a failure to fetch one icon should not
+	// stop the others being fetched.  FetchIcons then returns the
+	// icons that were fetched along with an IconErrors error holding
+	// the failures.
+	Partial bool
+
+	// ScaleRasterIcons specifies that PNG, JPEG and GIF icons larger
+	// than the icons in the diagram should be scaled down to fit,
+	// reducing the size of the generated SVG.  Raster icons are
+	// embedded as data URIs whether or not this is set.
+	ScaleRasterIcons bool
+
+	// Observer, if not nil, is notified of each icon fetched.
+	Observer FetchObserver
 }
 
 // FetchIcons retrieves icon SVGs over HTTP.  If specified in the struct, icons
-// will be fetched concurrently.
+// will be fetched concurrently.  If any icon cannot be fetched, or the
+// context is done, the remaining fetches are abandoned and the first error
+// is returned, naming the charm whose icon could not be fetched, unless
+// h.Partial is set.
 func (h *HTTPFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
 	client := http.DefaultClient
 	if h.Client != nil {
@@ -95,54 +161,276 @@ func (h *HTTPFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[
 	if concurrency <= 0 {
 		concurrency = 10
 	}
-	var iconsMu sync.Mutex // Guards icons.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex // Guards icons, iconErrs and fetchErr.
 	icons := make(map[string][]byte)
+	iconErrs := make(IconErrors)
+	var fetchErr error
 	alreadyFetched := make(map[string]bool)
 	run := parallel.NewRun(concurrency)
 	for _, applicationData := range b.Applications {
-		charmId, err := charm.ParseURL(applicationData.Charm)
+		charmId, path, err := parseCharm(applicationData.Charm)
 		if err != nil {
 			return nil, errgo.Notef(err, "cannot parse charm %q", applicationData.Charm)
 		}
-		path := charmId.Path()
 		if alreadyFetched[path] {
 			continue
 		}
 		alreadyFetched[path] = true
 		run.Do(func() error {
-			url, err := h.IconURL(ctx, charmId)
-			if err != nil {
-				return errgo.Mask(err, errgo.Any)
+			if ctx.Err() != nil {
+				// Another fetch has failed or the context is done.
+				return nil
+			}
+			icon, err := h.fetchCharmIcon(ctx, charmId, path, client)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && h.Partial && ctx.Err() == nil {
+				iconErrs[path] = err
+				return nil
 			}
-			icon, err := h.fetchIcon(url, client)
 			if err != nil {
-				return errgo.Mask(err, errgo.Any)
+				if fetchErr == nil {
+					fetchErr = errgo.NoteMask(err, fmt.Sprintf("cannot fetch icon for %q", charmId), errgo.Any)
+				}
+				cancel()
+				return nil
+			}
+			if icon != nil {
+				icons[path] = icon
 			}
-			iconsMu.Lock()
-			defer iconsMu.Unlock()
-			icons[path] = icon
 			return nil
 		})
 	}
-	if err := run.Wait(); err != nil {
-		return nil, errgo.Mask(err, errgo.Any)
+	run.Wait()
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errgo.NoteMask(err, "cannot fetch icons", errgo.Any)
+	}
+	if len(iconErrs) > 0 {
+		return icons, iconErrs
 	}
 	return icons, nil
 }
 
-// fetchIcon retrieves a single icon svg over HTTP.
-func (h *HTTPFetcher) fetchIcon(url string, client *http.Client) ([]byte, error) {
-	resp, err := client.Get(url)
+// IconErrors is the error returned by an IconFetcher that could fetch
+// only some of the icons for a bundle. It holds the error for each icon
+// that could not be fetched, keyed by charm path. Any icons that were
+// fetched are returned alongside it.
+type IconErrors map[string]error
+
+// Error implements error.Error by describing the first failure, in
+// charm path order.
+func (e IconErrors) Error() string {
+	paths := make([]string, 0, len(e))
+	for path := range e {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	switch len(paths) {
+	case 0:
+		return "no error"
+	case 1:
+		return fmt.Sprintf("cannot fetch icon for %q: %v", paths[0], e[paths[0]])
+	}
+	return fmt.Sprintf("cannot fetch icon for %q: %v (and %d more)", paths[0], e[paths[0]], len(paths)-1)
+}
+
+// fetchCharmIcon retrieves the icon for the given charm, which has the
+// given path, applying h.Timeout and notifying h.Observer.
+func (h *HTTPFetcher) fetchCharmIcon(ctx context.Context, charmId *charm.URL, path string, client *http.Client) (icon []byte, err error) {
+	ev := &FetchEvent{
+		CharmPath: path,
+	}
+	if h.Observer != nil {
+		ctx = h.Observer.FetchStarted(ctx, path)
+		start := time.Now()
+		defer func() {
+			ev.Bytes = len(icon)
+			ev.Duration = time.Since(start)
+			ev.Err = err
+			h.Observer.FetchDone(ctx, *ev)
+		}()
+	}
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	url, err := h.IconURL(ctx, charmId)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if url == "" {
+		return nil, nil
+	}
+	ev.URL = url
+	icon, err = h.fetchIcon(ctx, url, client, ev)
 	if err != nil {
-		return nil, errgo.Notef(err, "HTTP error fetching %s: %v", url, err)
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return icon, nil
+}
+
+// fetchIcon retrieves a single icon svg over HTTP, retrying as configured
+// and recording the outcome in ev.
+func (h *HTTPFetcher) fetchIcon(ctx context.Context, url string, client *http.Client, ev *FetchEvent) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		ev.Attempts++
+		icon, err := h.fetchIconOnce(ctx, url, client, ev)
+		if err == nil {
+			return icon, nil
+		}
+		retry, ok := errgo.Cause(err).(*retryableError)
+		if !ok || attempt >= h.Retries || ctx.Err() != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		delay := h.retryDelay(attempt)
+		if retry.after > delay {
+			if retry.after > h.maxRetryDelay() {
+				return nil, errgo.Notef(err, "server asked to retry after %v", retry.after)
+			}
+			delay = retry.after
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying after the given
+// attempt, counting from zero.
+func (h *HTTPFetcher) retryDelay(attempt int) time.Duration {
+	delay := h.RetryDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	for i := 0; i < attempt && delay < h.maxRetryDelay(); i++ {
+		delay *= 2
+	}
+	if delay > h.maxRetryDelay() {
+		delay = h.maxRetryDelay()
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (h *HTTPFetcher) maxRetryDelay() time.Duration {
+	if h.MaxRetryDelay <= 0 {
+		return 10 * time.Second
+	}
+	return h.MaxRetryDelay
+}
+
+// retryableError is used as the cause of errors from fetchIconOnce that
+// may not happen again if the request is retried.
+type retryableError struct {
+	// after holds the delay requested by the server with a
+	// Retry-After header, if any.
+	after time.Duration
+}
+
+func (*retryableError) Error() string {
+	return "retryable error"
+}
+
+// fetchIconOnce makes a single attempt to retrieve an icon svg over HTTP,
+// recording the response in ev.
+func (h *HTTPFetcher) fetchIconOnce(ctx context.Context, url string, client *http.Client, ev *FetchEvent) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot make request for %s", url)
+	}
+	var cached *CachedIcon
+	if h.Cache != nil {
+		cached = h.Cache.Get(url)
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.WithCausef(err, &retryableError{}, "HTTP error fetching %s", url)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
+	ev.StatusCode = resp.StatusCode
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		ev.CacheHit = true
+		return cached.Data, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, errgo.WithCausef(nil, &retryableError{
+			after: retryAfter(resp.Header.Get("Retry-After")),
+		}, "cannot retrieve icon from %s: %s", url, resp.Status)
+	case resp.StatusCode != http.StatusOK:
 		return nil, errgo.Newf("cannot retrieve icon from %s: %s", url, resp.Status)
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := h.readIcon(resp.Body)
 	if err != nil {
-		return nil, errgo.Notef(err, "could not read icon data from url %s", url)
+		return nil, errgo.NoteMask(err, fmt.Sprintf("could not read icon data from url %s", url), errgo.Any)
+	}
+	body, err = svgIcon(body, resp.Header.Get("Content-Type"), h.ScaleRasterIcons, DefaultIconLimits.MaxPixels)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid icon from %s", url)
+	}
+	if h.Cache != nil {
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			h.Cache.Put(url, &CachedIcon{
+				Data:         body,
+				ETag:         etag,
+				LastModified: lastModified,
+			})
+		}
 	}
 	return body, nil
 }
+
+// readIcon reads an icon from r, applying h.MaxIconBytes.
+func (h *HTTPFetcher) readIcon(r io.Reader) ([]byte, error) {
+	max := h.MaxIconBytes
+	if max == 0 {
+		max = DefaultIconLimits.MaxBytes
+	}
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.WithCausef(err, &retryableError{}, "")
+	}
+	if max > 0 && int64(len(data)) > max {
+		return nil, errgo.Newf("icon is larger than %d bytes", max)
+	}
+	return data, nil
+}
+
+// retryAfter returns the delay specified by the given Retry-After header
+// value, which may be a number of seconds or a date, or zero if there is
+// none.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -6,7 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/juju/charm/v7"
@@ -47,6 +49,25 @@ func TestLinkFetchIcons(t *testing.T) {
 	}
 }
 
+func TestIconMapFetchIcons(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	icons := IconMap{
+		"precise/mongodb-21": []byte("mongodb icon"),
+		"trusty/mysql-1":     []byte("mysql icon"),
+	}
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	// The icons are returned as they are, whatever the bundle.
+	fetched, err := icons.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fetched, qt.DeepEquals, map[string][]byte(icons))
+	fetched, err = icons.FetchIcons(ctx, &charm.BundleData{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(fetched, qt.DeepEquals, map[string][]byte(icons))
+}
+
 func TestHTTPFetchIcons(t *testing.T) {
 	c := qt.New(t)
 	ctx := context.Background()
@@ -116,11 +137,311 @@ func TestHTTPBadIconURL(t *testing.T) {
 		IconURL:     tsIconURL,
 	}
 	iconMap, err := fetcher.FetchIcons(ctx, b)
-	c.Assert(err, qt.ErrorMatches, fmt.Sprintf("cannot retrieve icon from %s.+\\.svg: 403 Forbidden.*", ts.URL))
+	c.Assert(err, qt.ErrorMatches, fmt.Sprintf(`cannot fetch icon for "cs:.+": cannot retrieve icon from %s.+\.svg: 403 Forbidden`, ts.URL))
 	c.Assert(iconMap, qt.IsNil)
 
 	fetcher.Concurrency = 10
 	iconMap, err = fetcher.FetchIcons(ctx, b)
-	c.Assert(err, qt.ErrorMatches, fmt.Sprintf("cannot retrieve icon from %s.+\\.svg: 403 Forbidden.*", ts.URL))
+	c.Assert(err, qt.ErrorMatches, fmt.Sprintf(`cannot fetch icon for "cs:.+": cannot retrieve icon from %s.+\.svg: 403 Forbidden`, ts.URL))
+	c.Assert(iconMap, qt.IsNil)
+}
+
+func TestHTTPFetchIconsTimeout(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	defer close(release)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "mongodb") {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		fmt.Fprintf(w, "<svg>%s</svg>", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(_ context.Context, ref *charm.URL) (string, error) {
+			return ts.URL + "/" + ref.Path() + ".svg", nil
+		},
+		Timeout: 50 * time.Millisecond,
+	}
+	iconMap, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "cs:precise/mongodb-21": HTTP error fetching .*/precise/mongodb-21\.svg: .*context deadline exceeded.*`)
+	c.Assert(iconMap, qt.IsNil)
+}
+
+func TestHTTPFetchIconsCancel(t *testing.T) {
+	c := qt.New(t)
+
+	requests := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	fetcher := HTTPFetcher{
+		Concurrency: 1,
+		IconURL: func(_ context.Context, ref *charm.URL) (string, error) {
+			return ts.URL + "/" + ref.Path() + ".svg", nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requests
+		cancel()
+	}()
+	iconMap, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "cs:.+": HTTP error fetching .*: .*context canceled.*`)
+	c.Assert(iconMap, qt.IsNil)
+	// The remaining icons are not requested once the first fetch is
+	// cancelled.
+	c.Assert(requests, qt.HasLen, 0)
+}
+
+func TestHTTPFetchIconsRetry(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		switch {
+		case strings.Contains(r.URL.Path, "mongodb") && n < 3:
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		case strings.Contains(r.URL.Path, "charmworld") && n < 2:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			fmt.Fprintf(w, "<svg>%s</svg>", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(_ context.Context, ref *charm.URL) (string, error) {
+			return ts.URL + "/" + ref.Path() + ".svg", nil
+		},
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+	}
+	iconMap, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconMap, qt.HasLen, 3)
+	c.Assert(requests, qt.DeepEquals, map[string]int{
+		"/~charming-devs/precise/elasticsearch-2.svg": 1,
+		"/~juju-jitsu/precise/charmworld-58.svg":      2,
+		"/precise/mongodb-21.svg":                     3,
+	})
+
+	// When the retries are exhausted, the last error is returned.
+	requests = make(map[string]int)
+	fetcher.Retries = 1
+	iconMap, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "cs:precise/mongodb-21": cannot retrieve icon from .*: 503 Service Unavailable`)
 	c.Assert(iconMap, qt.IsNil)
+	c.Assert(requests["/precise/mongodb-21.svg"], qt.Equals, 2)
+}
+
+func TestHTTPFetchIconsNoRetry(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+		if strings.Contains(r.URL.Path, "mongodb") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	b.Applications = map[string]*charm.ApplicationSpec{
+		"mongodb": b.Applications["mongodb"],
+	}
+	fetcher := HTTPFetcher{
+		IconURL: func(_ context.Context, ref *charm.URL) (string, error) {
+			return ts.URL + "/" + ref.Path() + ".svg", nil
+		},
+		Retries:       3,
+		RetryDelay:    time.Millisecond,
+		MaxRetryDelay: time.Second,
+	}
+	// Client errors are not retried.
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "cs:precise/mongodb-21": cannot retrieve icon from .*: 404 Not Found`)
+	c.Assert(count, qt.Equals, 1)
+
+	// Nor are responses asking for a longer delay than allowed.
+	b.Applications["mongodb"].Charm = "cs:precise/haproxy-35"
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "cs:precise/haproxy-35": server asked to retry after 1m0s: cannot retrieve icon from .*: 429 Too Many Requests`)
+	c.Assert(count, qt.Equals, 2)
+}
+
+func TestHTTPFetchIconsConditional(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var downloads []string
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "mongodb") {
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else {
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+			if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(t) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		mu.Lock()
+		downloads = append(downloads, r.URL.Path)
+		mu.Unlock()
+		fmt.Fprintf(w, "<svg>%s</svg>", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(_ context.Context, ref *charm.URL) (string, error) {
+			return ts.URL + "/" + ref.Path() + ".svg", nil
+		},
+		Cache: &MemoryHTTPCache{},
+	}
+	expected := map[string][]byte{
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>/~charming-devs/precise/elasticsearch-2.svg</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>/~juju-jitsu/precise/charmworld-58.svg</svg>"),
+		"precise/mongodb-21":                     []byte("<svg>/precise/mongodb-21.svg</svg>"),
+	}
+	iconMap, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconMap, qt.DeepEquals, expected)
+	c.Assert(downloads, qt.HasLen, 3)
+
+	// Unchanged icons are not downloaded again.
+	iconMap, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconMap, qt.DeepEquals, expected)
+	c.Assert(downloads, qt.HasLen, 3)
+
+	lastModified = lastModified.Add(time.Hour)
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(downloads, qt.HasLen, 5)
+}
+
+func TestRetryAfter(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(retryAfter(""), qt.Equals, time.Duration(0))
+	c.Assert(retryAfter("bad"), qt.Equals, time.Duration(0))
+	c.Assert(retryAfter("120"), qt.Equals, 2*time.Minute)
+	d := retryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	c.Assert(d > 59*time.Minute && d <= time.Hour, qt.IsTrue, qt.Commentf("%v", d))
+	c.Assert(retryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)), qt.Equals, time.Duration(0))
+}
+
+func TestHTTPFetcherRetryDelay(t *testing.T) {
+	c := qt.New(t)
+
+	fetcher := HTTPFetcher{
+		RetryDelay:    time.Second,
+		MaxRetryDelay: 5 * time.Second,
+	}
+	for i := 0; i < 20; i++ {
+		d := fetcher.retryDelay(0)
+		c.Assert(d >= 500*time.Millisecond && d <= time.Second, qt.IsTrue, qt.Commentf("%v", d))
+		d = fetcher.retryDelay(2)
+		c.Assert(d >= 2*time.Second && d <= 4*time.Second, qt.IsTrue, qt.Commentf("%v", d))
+		d = fetcher.retryDelay(10)
+		c.Assert(d >= 2500*time.Millisecond && d <= 5*time.Second, qt.IsTrue, qt.Commentf("%v", d))
+	}
+}
+
+func TestHTTPFetchIconsMaxIconBytes(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<svg>%s</svg>", strings.Repeat(" ", 100))
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(_ context.Context, ref *charm.URL) (string, error) {
+			return ts.URL + "/" + ref.Path() + ".svg", nil
+		},
+		MaxIconBytes: 50,
+		Retries:      3,
+	}
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "cs:.*": could not read icon data from url .*: icon is larger than 50 bytes`)
+
+	fetcher.MaxIconBytes = -1
+	iconMap, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconMap, qt.HasLen, 3)
+}
+
+func TestHTTPFetchIconsRaster(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	pngIcon := rasterIcon(c, 200, 200)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngIcon)
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(_ context.Context, ref *charm.URL) (string, error) {
+			return ts.URL + "/" + ref.Path() + ".png", nil
+		},
+	}
+	iconMap, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(iconMap, qt.HasLen, 3)
+	_, cfg := embeddedImage(c, iconMap["precise/mongodb-21"])
+	c.Assert(cfg.Width, qt.Equals, 200)
+
+	fetcher.ScaleRasterIcons = true
+	iconMap, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	_, cfg = embeddedImage(c, iconMap["precise/mongodb-21"])
+	c.Assert(cfg.Width, qt.Equals, 96)
 }
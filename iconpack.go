@@ -0,0 +1,236 @@
+package jujusvg
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// iconPackManifest holds the name of the manifest within an icon
+	// pack.
+	iconPackManifest = "manifest.json"
+
+	// iconPackVersion holds the version of the icon pack format
+	// written by WriteIconPack.
+	iconPackVersion = 1
+)
+
+// iconPackManifestData holds the contents of the manifest of an icon
+// pack. Icons holds the name of the file within the pack holding the
+// icon for each charm path, which includes the charm revision. Files
+// are named after the SHA-256 hash of their contents, which is checked
+// when the pack is read, so identical icons are stored only once.
+type iconPackManifestData struct {
+	Version int               `json:"version"`
+	Icons   map[string]string `json:"icons"`
+}
+
+// IconPack is an IconFetcher that serves icons from an icon pack, so
+// that bundles can be drawn without access to any icon host. An icon
+// pack is a zip archive, written by WriteIconPack, holding the icons
+// for a set of charms along with a manifest. Packs holding a file larger
+// than DefaultIconLimits.MaxBytes cannot be read.
+type IconPack struct {
+	icons map[string][]byte
+}
+
+// OpenIconPack reads the icon pack in the file with the given path.
+func OpenIconPack(path string) (*IconPack, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open icon pack")
+	}
+	defer r.Close()
+	pack, err := readIconPack(&r.Reader)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read icon pack %s", path)
+	}
+	return pack, nil
+}
+
+// ReadIconPack reads an icon pack of the given size from r.
+func ReadIconPack(r io.ReaderAt, size int64) (*IconPack, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read icon pack")
+	}
+	pack, err := readIconPack(zr)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read icon pack")
+	}
+	return pack, nil
+}
+
+// readIconPack reads the icons listed in the manifest of the given icon
+// pack.
+func readIconPack(r *zip.Reader) (*IconPack, error) {
+	files := make(map[string]*zip.File, len(r.File))
+	for _, file := range r.File {
+		files[file.Name] = file
+	}
+	manifestFile := files[iconPackManifest]
+	if manifestFile == nil {
+		return nil, errgo.Newf("no %s found", iconPackManifest)
+	}
+	data, err := readZipFile(manifestFile)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var manifest iconPackManifestData
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal %s", iconPackManifest)
+	}
+	if manifest.Version != iconPackVersion {
+		return nil, errgo.Newf("unsupported icon pack version %d", manifest.Version)
+	}
+	pack := &IconPack{
+		icons: make(map[string][]byte, len(manifest.Icons)),
+	}
+	for path, name := range manifest.Icons {
+		file := files[name]
+		if file == nil {
+			return nil, errgo.Newf("icon %q not found for %q", name, path)
+		}
+		icon, err := readZipFile(file)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if iconPackFile(icon) != name {
+			return nil, errgo.Newf("icon %q for %q does not match its checksum", name, path)
+		}
+		pack.icons[path] = icon
+	}
+	return pack, nil
+}
+
+// FetchIcons implements IconFetcher.FetchIcons. Charms whose icons are
+// not in the pack are omitted.
+func (p *IconPack) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	icons := make(map[string][]byte)
+	for _, applicationData := range b.Applications {
+		_, path, err := parseCharm(applicationData.Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse charm %q", applicationData.Charm)
+		}
+		if icon, ok := p.icons[path]; ok {
+			icons[path] = icon
+		}
+	}
+	return icons, nil
+}
+
+// Paths returns the charm paths of the icons in the pack, in sorted
+// order.
+func (p *IconPack) Paths() []string {
+	paths := make([]string, 0, len(p.icons))
+	for path := range p.icons {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// WriteIconPack writes an icon pack to w holding the icons for the
+// charms in the given bundles, as fetched by fetcher. The pack depends
+// only on the icons, so the same icons always produce the same pack.
+func WriteIconPack(ctx context.Context, w io.Writer, fetcher IconFetcher, bundles ...*charm.BundleData) error {
+	icons := make(map[string][]byte)
+	for _, b := range bundles {
+		fetched, err := fetcher.FetchIcons(ctx, b)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		for path, icon := range fetched {
+			icons[path] = icon
+		}
+	}
+	manifest := iconPackManifestData{
+		Version: iconPackVersion,
+		Icons:   make(map[string]string, len(icons)),
+	}
+	names := make([]string, 0, len(icons))
+	contents := make(map[string][]byte, len(icons))
+	for path, icon := range icons {
+		name := iconPackFile(icon)
+		manifest.Icons[path] = name
+		if _, ok := contents[name]; !ok {
+			names = append(names, name)
+			contents[name] = icon
+		}
+	}
+	sort.Strings(names)
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	zw := zip.NewWriter(w)
+	if err := writeZipFile(zw, iconPackManifest, data); err != nil {
+		return errgo.Mask(err)
+	}
+	for _, name := range names {
+		if err := writeZipFile(zw, name, contents[name]); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return errgo.Notef(err, "cannot write icon pack")
+	}
+	return nil
+}
+
+// iconPackFile returns the name of the file holding the given icon in an
+// icon pack.
+func iconPackFile(icon []byte) string {
+	sum := sha256.Sum256(icon)
+	return "icons/" + hex.EncodeToString(sum[:]) + ".icon"
+}
+
+// readZipFile returns the contents of the given file in a zip archive,
+// returning an error if it is larger than DefaultIconLimits.MaxBytes.
+// As the size recorded in the archive may be wrong, it is checked both
+// before and while reading the file.
+func readZipFile(file *zip.File) ([]byte, error) {
+	max := DefaultIconLimits.MaxBytes
+	if max > 0 && file.UncompressedSize64 > uint64(max) {
+		return nil, errgo.Newf("%s is larger than %d bytes", file.Name, max)
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open %s", file.Name)
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if max > 0 {
+		r = io.LimitReader(rc, max+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read %s", file.Name)
+	}
+	if max > 0 && int64(len(data)) > max {
+		return nil, errgo.Newf("%s is larger than %d bytes", file.Name, max)
+	}
+	return data, nil
+}
+
+// writeZipFile writes a file with the given name and contents to a zip
+// archive.
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return errgo.Notef(err, "cannot create %s", name)
+	}
+	if _, err := fw.Write(data); err != nil {
+		return errgo.Notef(err, "cannot write %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package jujusvg
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+func TestIconPack(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	other := &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"haproxy": {
+				Charm: "cs:precise/haproxy-35",
+			},
+		},
+	}
+	var buf bytes.Buffer
+	err = WriteIconPack(ctx, &buf, &pathFetcher{}, b, other)
+	c.Assert(err, qt.IsNil)
+
+	// The same icons always produce the same pack.
+	var buf2 bytes.Buffer
+	err = WriteIconPack(ctx, &buf2, &pathFetcher{}, other, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf2.Bytes(), qt.DeepEquals, buf.Bytes())
+
+	pack, err := ReadIconPack(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	c.Assert(err, qt.IsNil)
+	c.Assert(pack.Paths(), qt.DeepEquals, []string{
+		"precise/haproxy-35",
+		"precise/mongodb-21",
+		"~charming-devs/precise/elasticsearch-2",
+		"~juju-jitsu/precise/charmworld-58",
+	})
+
+	// Icons not in the pack are omitted.
+	b.Applications["mysql"] = &charm.ApplicationSpec{
+		Charm: "cs:precise/mysql-1",
+	}
+	icons, err := pack.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                     []byte("<svg>precise/mongodb-21</svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>~charming-devs/precise/elasticsearch-2</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>~juju-jitsu/precise/charmworld-58</svg>"),
+	})
+
+	path := filepath.Join(c.Mkdir(), "icons.zip")
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	c.Assert(err, qt.IsNil)
+	pack, err = OpenIconPack(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pack.Paths(), qt.HasLen, 4)
+}
+
+func TestReadIconPackErrors(t *testing.T) {
+	c := qt.New(t)
+
+	tests := []struct {
+		about string
+		files map[string]string
+		err   string
+	}{{
+		about: "no manifest",
+		files: map[string]string{},
+		err:   `cannot read icon pack: no manifest.json found`,
+	}, {
+		about: "bad manifest",
+		files: map[string]string{
+			"manifest.json": "{",
+		},
+		err: `cannot read icon pack: cannot unmarshal manifest.json: .*`,
+	}, {
+		about: "unsupported version",
+		files: map[string]string{
+			"manifest.json": `{"version": 2}`,
+		},
+		err: `cannot read icon pack: unsupported icon pack version 2`,
+	}, {
+		about: "missing icon",
+		files: map[string]string{
+			"manifest.json": `{"version": 1, "icons": {"precise/mysql-1": "icons/x.icon"}}`,
+		},
+		err: `cannot read icon pack: icon "icons/x.icon" not found for "precise/mysql-1"`,
+	}, {
+		about: "modified icon",
+		files: map[string]string{
+			"manifest.json": `{"version": 1, "icons": {"precise/mysql-1": "icons/x.icon"}}`,
+			"icons/x.icon":  "<svg/>",
+		},
+		err: `cannot read icon pack: icon "icons/x.icon" for "precise/mysql-1" does not match its checksum`,
+	}, {
+		about: "large manifest",
+		files: map[string]string{
+			"manifest.json": `{"version": 1}` + strings.Repeat(" ", int(DefaultIconLimits.MaxBytes)),
+		},
+		err: `cannot read icon pack: manifest.json is larger than 1048576 bytes`,
+	}, {
+		about: "large icon",
+		files: map[string]string{
+			"manifest.json": `{"version": 1, "icons": {"precise/mysql-1": "icons/x.icon"}}`,
+			"icons/x.icon":  strings.Repeat(" ", int(DefaultIconLimits.MaxBytes)+1),
+		},
+		err: `cannot read icon pack: icons/x.icon is larger than 1048576 bytes`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			var buf bytes.Buffer
+			zw := zip.NewWriter(&buf)
+			for name, data := range test.files {
+				w, err := zw.Create(name)
+				c.Assert(err, qt.IsNil)
+				w.Write([]byte(data))
+			}
+			err := zw.Close()
+			c.Assert(err, qt.IsNil)
+			_, err = ReadIconPack(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			c.Assert(err, qt.ErrorMatches, test.err)
+		})
+	}
+
+	_, err := ReadIconPack(strings.NewReader("not a zip"), 9)
+	c.Assert(err, qt.ErrorMatches, `cannot read icon pack: zip: not a valid zip file`)
+}
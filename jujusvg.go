@@ -7,7 +7,6 @@ import (
 	"math"
 	"sort"
 	"strconv"
-	"strings"
 
 	"github.com/juju/charm/v7"
 	"gopkg.in/errgo.v1"
@@ -22,6 +21,13 @@ import (
 // allowing the generated bundle to be self-contained. If fetcher
 // is nil, a default fetcher which refers to icons by their
 // URLs as svg <image> tags will be used.
+//
+// SAAS entries, which consume offers from other models, are drawn with
+// a dashed outline and placed automatically. As a SAAS entry does not
+// name the charm behind the offer, its icon is taken from those
+// returned by the fetcher under the key returned by SaasIconKey, as
+// FetchIconsForSources provides. If there is no such icon, the SAAS
+// entry is drawn without one.
 func NewFromBundle(ctx context.Context, b *charm.BundleData, iconURL func(context.Context, *charm.URL) (string, error), fetcher IconFetcher) (*Canvas, error) {
 	if fetcher == nil {
 		fetcher = &LinkFetcher{
@@ -37,20 +43,34 @@ func NewFromBundle(ctx context.Context, b *charm.BundleData, iconURL func(contex
 
 	// Verify the bundle to make sure that all the invariants
 	// that we depend on below actually hold true.
-	if err := b.Verify(nil, nil, nil); err != nil {
+	if err := verifyBundle(b); err != nil {
 		return nil, errgo.Notef(err, "cannot verify bundle")
 	}
 	// Go through all applications in alphabetical order so that
 	// we get consistent results.
-	applicationNames := make([]string, 0, len(b.Applications))
+	applicationNames := make([]string, 0, len(b.Applications)+len(b.Saas))
 	for name := range b.Applications {
 		applicationNames = append(applicationNames, name)
 	}
+	for name := range b.Saas {
+		applicationNames = append(applicationNames, name)
+	}
 	sort.Strings(applicationNames)
 	applications := make(map[string]*application)
 	applicationsNeedingPlacement := make(map[string]bool)
 	for _, name := range applicationNames {
-		applicationData := b.Applications[name]
+		applicationData, ok := b.Applications[name]
+		if !ok {
+			key := SaasIconKey(name)
+			applications[name] = &application{
+				name:      name,
+				charmPath: key,
+				iconSrc:   rasterToSVG(iconMap[key]),
+				saas:      true,
+			}
+			applicationsNeedingPlacement[name] = true
+			continue
+		}
 		x, xerr := strconv.ParseFloat(applicationData.Annotations["gui-x"], 64)
 		y, yerr := strconv.ParseFloat(applicationData.Annotations["gui-y"], 64)
 		if xerr != nil || yerr != nil {
@@ -62,19 +82,19 @@ func NewFromBundle(ctx context.Context, b *charm.BundleData, iconURL func(contex
 				return nil, errgo.Newf("application %q does not have a valid position", name)
 			}
 		}
-		charmID, err := charm.ParseURL(applicationData.Charm)
+		charmID, charmPath, err := parseCharm(applicationData.Charm)
 		if err != nil {
 			// cannot actually happen, as we've verified it.
 			return nil, errgo.Notef(err, "cannot parse charm %q", applicationData.Charm)
 		}
-		icon := iconMap[charmID.Path()]
+		icon := rasterToSVG(iconMap[charmPath])
 		iconURL, err := iconURL(ctx, charmID)
 		if err != nil {
 			return nil, errgo.Mask(err, errgo.Any)
 		}
 		svc := &application{
 			name:      name,
-			charmPath: charmID.Path(),
+			charmPath: charmPath,
 			point:     image.Point{int(x), int(y)},
 			iconUrl:   iconURL,
 			iconSrc:   icon,
@@ -82,7 +102,10 @@ func NewFromBundle(ctx context.Context, b *charm.BundleData, iconURL func(contex
 		applications[name] = svc
 	}
 	padding := image.Point{int(math.Floor(applicationBlockSize * 1.5)), int(math.Floor(applicationBlockSize * 0.5))}
-	for name := range applicationsNeedingPlacement {
+	for _, name := range applicationNames {
+		if !applicationsNeedingPlacement[name] {
+			continue
+		}
 		vertices := []image.Point{}
 		for n, svc := range applications {
 			if !applicationsNeedingPlacement[n] {
@@ -96,11 +119,32 @@ func NewFromBundle(ctx context.Context, b *charm.BundleData, iconURL func(contex
 		canvas.addApplication(applications[name])
 	}
 	for _, relation := range b.Relations {
+		applicationA := applications[endpointApplication(relation[0])]
+		applicationB := applications[endpointApplication(relation[1])]
 		canvas.addRelation(&applicationRelation{
 			name:         fmt.Sprintf("%s %s", relation[0], relation[1]),
-			applicationA: applications[strings.Split(relation[0], ":")[0]],
-			applicationB: applications[strings.Split(relation[1], ":")[0]],
+			endpointA:    relation[0],
+			endpointB:    relation[1],
+			applicationA: applicationA,
+			applicationB: applicationB,
 		})
 	}
 	return &canvas, nil
 }
+
+// SaasIconKey returns the key under which an IconFetcher may return the
+// icon for the SAAS entry with the given name.
+func SaasIconKey(name string) string {
+	return "saas:" + name
+}
+
+// rasterToSVG returns the given icon converted as by svgIcon, as
+// fetchers other than HTTPFetcher may return raster icons. Icons that
+// cannot be converted are returned unchanged, leaving Marshal to
+// replace them with a link.
+func rasterToSVG(icon []byte) []byte {
+	if svg, err := svgIcon(icon, "", false, DefaultIconLimits.MaxPixels); err == nil {
+		return svg
+	}
+	return icon
+}
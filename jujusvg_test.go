@@ -226,6 +226,54 @@ func TestNewFromBundleWithUnplacedApplication(t *testing.T) {
 `))
 }
 
+func TestNewFromBundleWithSaas(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(`
+applications:
+  wordpress:
+    charm: cs:trusty/wordpress-5
+    annotations:
+      gui-x: "0"
+      gui-y: "0"
+saas:
+  db:
+    url: admin/other.mysql
+  cache:
+    url: admin/other.memcached
+relations:
+  - ["wordpress:db", "db:db"]
+  - ["wordpress:cache", "cache:cache"]
+`))
+	c.Assert(err, qt.IsNil)
+	cvs, err := NewFromBundle(ctx, b, iconURL, IconMap{
+		"trusty/wordpress-5": []byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect id="wordpress"/></svg>`),
+		SaasIconKey("db"):    []byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect id="db"/></svg>`),
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cvs.applications, qt.HasLen, 3)
+	c.Assert(cvs.relations, qt.HasLen, 2)
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	out := buf.String()
+	c.Logf("%s", out)
+	// The SAAS entries are drawn with a dashed outline, using the
+	// icon given for one of them and no icon for the other.
+	c.Assert(strings.Count(out, `stroke="#888" stroke-width="1" stroke-dasharray="6, 3"`), qt.Equals, 2)
+	c.Assert(out, qt.Contains, `<rect id="icon-1-db"`)
+	c.Assert(out, qt.Contains, "<title>wordpress:cache cache:cache</title>")
+	c.Assert(strings.Count(out, "<image"), qt.Equals, 0)
+
+	// SAAS entries are placed automatically and have no positions
+	// to write back to the bundle.
+	positions := cvs.Positions()
+	c.Assert(positions, qt.HasLen, 1)
+	err = SetBundlePositions(b, positions)
+	c.Assert(err, qt.IsNil)
+}
+
 func TestWithFetcher(t *testing.T) {
 	c := qt.New(t)
 	ctx := context.Background()
@@ -0,0 +1,53 @@
+package jujusvg
+
+// IconLimits holds limits on the size and complexity of icons, so that
+// broken or malicious icons cannot exhaust the resources of the process
+// drawing them. A limit of zero means that the respective quantity is
+// not limited.
+type IconLimits struct {
+	// MaxBytes holds the maximum size of an icon in bytes.
+	MaxBytes int64
+
+	// MaxElements holds the maximum number of elements in an icon.
+	MaxElements int
+
+	// MaxDepth holds the maximum depth to which elements in an icon
+	// may be nested.
+	MaxDepth int
+
+	// MaxDataURIBytes holds the maximum size of a data URI, such as
+	// an embedded raster image, in an icon.
+	MaxDataURIBytes int
+
+	// MaxPixels holds the maximum number of pixels, the width times
+	// the height, of a raster icon. Raster icons are converted when
+	// they are fetched or when the canvas is created, so only the
+	// value in DefaultIconLimits applies.
+	MaxPixels int64
+}
+
+// DefaultIconLimits holds the limits applied to icons when no others
+// are specified. They are generous enough for any reasonable charm
+// icon.
+var DefaultIconLimits = IconLimits{
+	MaxBytes:        1 << 20,
+	MaxElements:     10000,
+	MaxDepth:        100,
+	MaxDataURIBytes: 512 << 10,
+	MaxPixels:       4096 * 4096,
+}
+
+// SetIconLimits sets the limits applied to icons when drawing the
+// canvas. Icons that exceed them are drawn by referring to their URLs
+// instead of being embedded. By default, DefaultIconLimits is used.
+func (c *Canvas) SetIconLimits(limits IconLimits) {
+	c.iconLimits = &limits
+}
+
+// limits returns the limits applied to icons when drawing the canvas.
+func (c *Canvas) limits() IconLimits {
+	if c.iconLimits == nil {
+		return DefaultIconLimits
+	}
+	return *c.iconLimits
+}
@@ -0,0 +1,116 @@
+package jujusvg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestIconLimits(t *testing.T) {
+	c := qt.New(t)
+
+	tests := []struct {
+		about  string
+		icon   string
+		limits IconLimits
+		err    string
+	}{{
+		about: "within limits",
+		icon:  `<svg xmlns="http://www.w3.org/2000/svg"><g><rect/></g><image href="data:image/png;base64,AAAA"/></svg>`,
+		limits: IconLimits{
+			MaxBytes:        200,
+			MaxElements:     4,
+			MaxDepth:        3,
+			MaxDataURIBytes: 30,
+		},
+	}, {
+		about: "too large",
+		icon:  `<svg xmlns="http://www.w3.org/2000/svg"><rect/></svg>`,
+		limits: IconLimits{
+			MaxBytes: 40,
+		},
+		err: "icon is larger than 40 bytes",
+	}, {
+		about: "too many elements",
+		icon:  `<svg xmlns="http://www.w3.org/2000/svg"><rect/><rect/><rect/></svg>`,
+		limits: IconLimits{
+			MaxElements: 3,
+		},
+		err: "icon has more than 3 elements",
+	}, {
+		about: "removed elements are counted",
+		icon:  `<svg xmlns="http://www.w3.org/2000/svg"><script/><script/><script/></svg>`,
+		limits: IconLimits{
+			MaxElements: 3,
+		},
+		err: "icon has more than 3 elements",
+	}, {
+		about: "nested too deeply",
+		icon:  `<svg xmlns="http://www.w3.org/2000/svg"><g><g><g/></g></g></svg>`,
+		limits: IconLimits{
+			MaxDepth: 3,
+		},
+		err: "icon has elements nested more than 3 deep",
+	}, {
+		about: "data URI too large",
+		icon:  `<svg xmlns="http://www.w3.org/2000/svg"><image href="data:image/png;base64,AAAAAAAAAAAA"/></svg>`,
+		limits: IconLimits{
+			MaxDataURIBytes: 30,
+		},
+		err: "icon has a data URI larger than 30 bytes",
+	}, {
+		about: "no limits",
+		icon:  `<svg xmlns="http://www.w3.org/2000/svg">` + strings.Repeat(`<g>`, 200) + strings.Repeat(`</g>`, 200) + `</svg>`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			_, err := processIcon(strings.NewReader(test.icon), ioutil.Discard, "icon", iconOptions{
+				limits: test.limits,
+			})
+			if test.err != "" {
+				c.Assert(err, qt.ErrorMatches, test.err)
+			} else {
+				c.Assert(err, qt.IsNil)
+			}
+		})
+	}
+}
+
+func TestSetIconLimits(t *testing.T) {
+	c := qt.New(t)
+
+	var canvas Canvas
+	canvas.addApplication(&application{
+		name:      "application-a",
+		charmPath: "trusty/svc-a",
+		iconUrl:   "https://example.com/svc-a.svg",
+		iconSrc:   []byte(`<svg xmlns="http://www.w3.org/2000/svg"><g><g><rect/></g></g></svg>`),
+	})
+	canvas.addApplication(&application{
+		name:      "application-b",
+		charmPath: "trusty/svc-b",
+		iconUrl:   "https://example.com/svc-b.svg",
+		iconSrc:   []byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect/></svg>`),
+	})
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), qt.Contains, `xlink:href="#icon-1"`)
+	c.Assert(buf.String(), qt.Contains, `xlink:href="#icon-2"`)
+
+	// An icon that exceeds the limits is drawn from its URL instead,
+	// and the output is still valid.
+	canvas.SetIconLimits(IconLimits{
+		MaxDepth: 2,
+	})
+	buf.Reset()
+	canvas.Marshal(&buf)
+	out := buf.String()
+	c.Assert(out, qt.Not(qt.Contains), `<rect></rect></g></g>`)
+	c.Assert(out, qt.Not(qt.Contains), `xlink:href="#icon-1"`)
+	c.Assert(out, qt.Contains, `<image x="42" y="42" width="96" height="96" xlink:href="https://example.com/svc-a.svg" clip-path="url(#clip-mask)" />`)
+	c.Assert(out, qt.Contains, `xlink:href="#icon-2"`)
+	xmlTokens(c, buf.Bytes())
+}
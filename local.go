@@ -0,0 +1,212 @@
+package jujusvg
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+// localCharmIcon holds the path of the icon within a charm.
+const localCharmIcon = "icon.svg"
+
+// LocalFetcher is an IconFetcher that reads the icons of local charms,
+// which are specified in a bundle by path rather than by charm URL.
+// A local charm may be an unpacked charm directory or a charm archive.
+type LocalFetcher struct {
+	// Dir holds the directory relative to which the paths of local
+	// charms are resolved, typically the directory holding the
+	// bundle. If it is empty, the current directory is used.
+	Dir string
+
+	// Fetcher is used to fetch the icons of charms that are not
+	// local. If it is nil, those icons are omitted.
+	Fetcher IconFetcher
+
+	// MaxIconBytes specifies the maximum size of an icon. Larger
+	// icons are not read in full, and cause an error. If it is zero,
+	// DefaultIconLimits.MaxBytes will be used; if it is negative, the
+	// size is not limited.
+	MaxIconBytes int64
+}
+
+// FetchIcons implements IconFetcher.FetchIcons. Icons of local charms
+// are held under the charm path as given in the bundle. Local charms
+// that have no icon are omitted.
+func (f *LocalFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	icons := make(map[string][]byte)
+	remote := &charm.BundleData{
+		Applications: make(map[string]*charm.ApplicationSpec),
+	}
+	for name, applicationData := range b.Applications {
+		if !isLocalCharm(applicationData.Charm) {
+			remote.Applications[name] = applicationData
+			continue
+		}
+		if _, ok := icons[applicationData.Charm]; ok {
+			continue
+		}
+		icon, err := f.readIcon(applicationData.Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read icon for %q", applicationData.Charm)
+		}
+		icons[applicationData.Charm] = icon
+	}
+	for path, icon := range icons {
+		if icon == nil {
+			delete(icons, path)
+		}
+	}
+	if f.Fetcher == nil || len(remote.Applications) == 0 {
+		return icons, nil
+	}
+	fetched, err := f.Fetcher.FetchIcons(ctx, remote)
+	if _, ok := errgo.Cause(err).(IconErrors); err != nil && !ok {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	for path, icon := range fetched {
+		icons[path] = icon
+	}
+	return icons, err
+}
+
+// readIcon reads the icon of the local charm at the given path, which
+// may be a directory or an archive. It returns nil if the charm has no
+// icon.
+func (f *LocalFetcher) readIcon(charmPath string) ([]byte, error) {
+	if !filepath.IsAbs(charmPath) {
+		charmPath = filepath.Join(f.Dir, charmPath)
+	}
+	info, err := os.Stat(charmPath)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	max := f.MaxIconBytes
+	if max == 0 {
+		max = DefaultIconLimits.MaxBytes
+	}
+	if info.IsDir() {
+		r, err := os.Open(filepath.Join(charmPath, localCharmIcon))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer r.Close()
+		return readLimited(r, max)
+	}
+	zr, err := zip.OpenReader(charmPath)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open charm archive")
+	}
+	defer zr.Close()
+	for _, file := range zr.File {
+		// Archives may name their files with a leading ./ or /.
+		if path.Clean("/"+file.Name) != "/"+localCharmIcon {
+			continue
+		}
+		if max > 0 && file.UncompressedSize64 > uint64(max) {
+			return nil, errgo.Newf("icon is larger than %d bytes", max)
+		}
+		r, err := file.Open()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot open %s in charm archive", localCharmIcon)
+		}
+		defer r.Close()
+		icon, err := readLimited(r, max)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read %s from charm archive", localCharmIcon)
+		}
+		return icon, nil
+	}
+	return nil, nil
+}
+
+// readLimited reads an icon from r, returning an error if it is larger
+// than max bytes. If max is not positive, the size is not limited.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if max > 0 && int64(len(data)) > max {
+		return nil, errgo.Newf("icon is larger than %d bytes", max)
+	}
+	return data, nil
+}
+
+// isLocalCharm reports whether the given charm of an application in a
+// bundle refers to a local charm by path, using the same rule as
+// charm.BundleData.Verify.
+func isLocalCharm(charmRef string) bool {
+	return strings.HasPrefix(charmRef, ".") || filepath.IsAbs(charmRef)
+}
+
+// parseCharm parses the charm of an application in a bundle. It returns
+// the charm URL, and the key under which the icon of the charm is held
+// by an IconFetcher: the path of the charm URL, the charm reference
+// itself for a Charmhub charm, or for a local charm the path given in
+// the bundle. Local charms are given a URL with the local schema, named
+// after their directory or archive.
+func parseCharm(charmRef string) (*charm.URL, string, error) {
+	if strings.HasPrefix(charmRef, charmhubSchema+":") {
+		name := strings.TrimPrefix(charmRef, charmhubSchema+":")
+		if err := charm.ValidateName(name); err != nil {
+			return nil, "", errgo.Notef(err, "invalid Charmhub charm %q", charmRef)
+		}
+		return &charm.URL{
+			Schema:   charmhubSchema,
+			Name:     name,
+			Revision: -1,
+		}, charmRef, nil
+	}
+	if isLocalCharm(charmRef) {
+		name := strings.TrimSuffix(filepath.Base(charmRef), ".charm")
+		return &charm.URL{
+			Schema:   "local",
+			Name:     name,
+			Revision: -1,
+		}, charmRef, nil
+	}
+	curl, err := charm.ParseURL(charmRef)
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	return curl, curl.Path(), nil
+}
+
+// verifyBundle verifies that the bundle is consistent. Drawing a bundle
+// does not need the charms themselves, so unlike
+// charm.BundleData.Verify, it is not an error for the path of a local
+// charm not to exist; local charms are verified as if they were given
+// by a local charm URL. Charmhub charms, which charm.BundleData.Verify
+// does not recognise, are verified as charm store charms of the same
+// name.
+func verifyBundle(b *charm.BundleData) error {
+	b1 := *b
+	b1.Applications = make(map[string]*charm.ApplicationSpec, len(b.Applications))
+	for name, app := range b.Applications {
+		if app != nil && (strings.HasPrefix(app.Charm, charmhubSchema+":") || isLocalCharm(app.Charm)) {
+			app1 := *app
+			if isLocalCharm(app.Charm) {
+				app1.Charm = "local:charm"
+			} else {
+				app1.Charm = "cs:" + strings.TrimPrefix(app.Charm, charmhubSchema+":")
+			}
+			app = &app1
+		}
+		b1.Applications[name] = app
+	}
+	return b1.Verify(nil, nil, nil)
+}
@@ -0,0 +1,209 @@
+package jujusvg
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+const localBundle = `
+applications:
+  wordpress:
+    charm: ./charms/wordpress
+    num_units: 1
+    annotations:
+      gui-x: "0"
+      gui-y: "0"
+  mysql:
+    charm: ./charms/mysql.charm
+    num_units: 1
+    annotations:
+      gui-x: "300"
+      gui-y: "0"
+  haproxy:
+    charm: ./charms/haproxy
+    num_units: 1
+    annotations:
+      gui-x: "600"
+      gui-y: "0"
+  mongodb:
+    charm: cs:precise/mongodb-21
+    num_units: 1
+    annotations:
+      gui-x: "900"
+      gui-y: "0"
+relations:
+  - ["wordpress:db", "mysql:db"]
+`
+
+// makeLocalCharms creates the local charms used by localBundle in the
+// given directory.
+func makeLocalCharms(c *qt.C, dir string) {
+	charms := filepath.Join(dir, "charms")
+	for _, name := range []string{"wordpress", "haproxy"} {
+		err := os.MkdirAll(filepath.Join(charms, name), 0755)
+		c.Assert(err, qt.IsNil)
+	}
+	err := ioutil.WriteFile(filepath.Join(charms, "wordpress", "icon.svg"), []byte(`<svg xmlns="http://www.w3.org/2000/svg">wordpress</svg>`), 0644)
+	c.Assert(err, qt.IsNil)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("metadata.yaml")
+	c.Assert(err, qt.IsNil)
+	w.Write([]byte("name: mysql\n"))
+	w, err = zw.Create("icon.svg")
+	c.Assert(err, qt.IsNil)
+	w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg">mysql</svg>`))
+	err = zw.Close()
+	c.Assert(err, qt.IsNil)
+	err = ioutil.WriteFile(filepath.Join(charms, "mysql.charm"), buf.Bytes(), 0644)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestLocalFetcher(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	dir := c.Mkdir()
+	makeLocalCharms(c, dir)
+	b, err := charm.ReadBundleData(strings.NewReader(localBundle))
+	c.Assert(err, qt.IsNil)
+
+	underlying := &pathFetcher{}
+	fetcher := &LocalFetcher{
+		Dir:     dir,
+		Fetcher: underlying,
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.DeepEquals, map[string][]byte{
+		"./charms/wordpress":   []byte(`<svg xmlns="http://www.w3.org/2000/svg">wordpress</svg>`),
+		"./charms/mysql.charm": []byte(`<svg xmlns="http://www.w3.org/2000/svg">mysql</svg>`),
+		"precise/mongodb-21":   []byte("<svg>precise/mongodb-21</svg>"),
+	})
+	c.Assert(underlying.fetched, qt.DeepEquals, map[string]int{
+		"precise/mongodb-21": 1,
+	})
+
+	// Without another fetcher, only local icons are returned.
+	fetcher.Fetcher = nil
+	icons, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.HasLen, 2)
+
+	// A missing charm is an error.
+	b.Applications["haproxy"].Charm = "./charms/missing"
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot read icon for "./charms/missing": stat .*: no such file or directory`)
+
+	// So is a file that is not a charm archive.
+	err = ioutil.WriteFile(filepath.Join(dir, "charms", "bad.charm"), []byte("bad"), 0644)
+	c.Assert(err, qt.IsNil)
+	b.Applications["haproxy"].Charm = "./charms/bad.charm"
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot read icon for "./charms/bad.charm": cannot open charm archive: .*`)
+}
+
+func TestLocalFetcherLimits(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	dir := c.Mkdir()
+	makeLocalCharms(c, dir)
+	icon := []byte(`<svg xmlns="http://www.w3.org/2000/svg">` + strings.Repeat(" ", 100) + `</svg>`)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("./icon.svg")
+	c.Assert(err, qt.IsNil)
+	w.Write(icon)
+	err = zw.Close()
+	c.Assert(err, qt.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "charms", "big.charm"), buf.Bytes(), 0644)
+	c.Assert(err, qt.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "charms", "haproxy", "icon.svg"), icon, 0644)
+	c.Assert(err, qt.IsNil)
+
+	b := &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"big": {
+				Charm: "./charms/big.charm",
+			},
+		},
+	}
+	// The icon is found even though its name in the archive
+	// has a leading ./.
+	fetcher := &LocalFetcher{
+		Dir: dir,
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.DeepEquals, map[string][]byte{
+		"./charms/big.charm": icon,
+	})
+
+	// Icons larger than the limit are not read.
+	fetcher.MaxIconBytes = 50
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot read icon for "./charms/big.charm": icon is larger than 50 bytes`)
+	b.Applications["big"].Charm = "./charms/haproxy"
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot read icon for "./charms/haproxy": icon is larger than 50 bytes`)
+}
+
+func TestNewFromBundleLocalCharms(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	dir := c.Mkdir()
+	makeLocalCharms(c, dir)
+	b, err := charm.ReadBundleData(strings.NewReader(localBundle))
+	c.Assert(err, qt.IsNil)
+
+	var urls []string
+	iconURL := func(_ context.Context, curl *charm.URL) (string, error) {
+		urls = append(urls, curl.String())
+		return "http://0.1.2.3/" + curl.Name + ".svg", nil
+	}
+	// The local charms need not exist relative to the current
+	// directory.
+	cvs, err := NewFromBundle(ctx, b, iconURL, &LocalFetcher{
+		Dir: dir,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(urls, qt.ContentEquals, []string{
+		"local:haproxy",
+		"local:mysql",
+		"local:wordpress",
+		"cs:precise/mongodb-21",
+	})
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), qt.Contains, `<svg xmlns="http://www.w3.org/2000/svg" id="icon-2">wordpress</svg>`)
+	c.Assert(buf.String(), qt.Contains, `xlink:href="http://0.1.2.3/haproxy.svg"`)
+}
+
+func TestVerifyBundle(t *testing.T) {
+	c := qt.New(t)
+
+	b, err := charm.ReadBundleData(strings.NewReader(localBundle))
+	c.Assert(err, qt.IsNil)
+	err = verifyBundle(b)
+	c.Assert(err, qt.IsNil)
+
+	// Other errors are still reported.
+	b.Applications["mongodb"].Charm = "bad:wolf"
+	err = verifyBundle(b)
+	c.Assert(err, qt.ErrorMatches, `invalid charm URL in application "mongodb": .*`)
+}
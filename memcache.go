@@ -0,0 +1,287 @@
+package jujusvg
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+// MemoryCacheFetcher is an IconFetcher that keeps the most recently used
+// icons retrieved by another IconFetcher in memory. Icons are keyed by
+// charm path. When several concurrent calls to FetchIcons need the same
+// icon, it is only fetched once and the result is shared between them.
+//
+// A MemoryCacheFetcher is safe for concurrent use.
+type MemoryCacheFetcher struct {
+	// Fetcher is used to retrieve icons that are not in the cache.
+	Fetcher IconFetcher
+
+	// MaxIcons holds the maximum number of icons to keep. If it is
+	// not positive, 100 will be used.
+	MaxIcons int
+
+	// Observer, if not nil, is notified of each icon found in the
+	// cache. Icons that are not found are reported by the observer
+	// of Fetcher, if any.
+	Observer FetchObserver
+
+	// mu guards the fields below.
+	mu sync.Mutex
+
+	// icons holds the cached icons, keyed by charm path.
+	icons *lruCache
+
+	// inflight holds the fetches in progress, keyed by charm path.
+	inflight map[string]*iconCall
+
+	stats CacheStats
+}
+
+// CacheStats holds statistics about the use of a MemoryCacheFetcher.
+type CacheStats struct {
+	// Hits holds the number of icons found in the cache.
+	Hits int64
+
+	// Misses holds the number of icons that were not in the cache
+	// and so were fetched.
+	Misses int64
+
+	// Shared holds the number of icons that were not in the cache
+	// but were already being fetched for another caller, so the
+	// result of that fetch was used.
+	Shared int64
+
+	// Evictions holds the number of icons removed from the cache to
+	// make room for others.
+	Evictions int64
+
+	// Icons holds the number of icons currently in the cache.
+	Icons int
+}
+
+// iconCall holds a fetch of a single icon that is in progress or
+// complete. The icon, err and abandoned fields must not be read until
+// done is closed.
+type iconCall struct {
+	done chan struct{}
+	icon []byte
+	err  error
+
+	// abandoned records that the context of the caller that made
+	// the fetch was done when the fetch finished, so any failure
+	// may be due to that rather than to the icon itself.
+	abandoned bool
+}
+
+// Stats returns the statistics for the cache so far.
+func (f *MemoryCacheFetcher) Stats() CacheStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := f.stats
+	if f.icons != nil {
+		stats.Icons = f.icons.len()
+	}
+	return stats
+}
+
+// FetchIcons implements IconFetcher.FetchIcons by returning cached icons
+// where possible and fetching the remainder with f.Fetcher. If f.Fetcher
+// returns an IconErrors error, the icons it did fetch are cached and
+// returned along with an IconErrors error holding the failures. A
+// caller that shares the fetch of another whose context is cancelled
+// fetches the icon again rather than sharing the resulting failure.
+func (f *MemoryCacheFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	// Map each charm path to an application using it, so that the
+	// icons still needed can be fetched with a bundle of just
+	// those applications.
+	paths := make(map[string]string)
+	for name, applicationData := range b.Applications {
+		_, path, err := parseCharm(applicationData.Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse charm %q", applicationData.Charm)
+		}
+		paths[path] = name
+	}
+
+	start := time.Now()
+	icons := make(map[string][]byte)
+	owned := make(map[string]*iconCall)
+	shared := make(map[string]*iconCall)
+	missing := &charm.BundleData{
+		Applications: make(map[string]*charm.ApplicationSpec),
+	}
+	f.mu.Lock()
+	if f.icons == nil {
+		maxIcons := f.MaxIcons
+		if maxIcons <= 0 {
+			maxIcons = 100
+		}
+		f.icons = newLRUCache(maxIcons)
+		f.inflight = make(map[string]*iconCall)
+	}
+	for path, name := range paths {
+		if icon, ok := f.icons.get(path); ok {
+			icons[path] = icon.([]byte)
+			f.stats.Hits++
+			continue
+		}
+		if call, ok := f.inflight[path]; ok {
+			shared[path] = call
+			f.stats.Shared++
+			continue
+		}
+		call := &iconCall{
+			done: make(chan struct{}),
+		}
+		f.inflight[path] = call
+		owned[path] = call
+		missing.Applications[name] = b.Applications[name]
+		f.stats.Misses++
+	}
+	f.mu.Unlock()
+	for path, icon := range icons {
+		observeCacheHit(ctx, f.Observer, path, icon, start)
+	}
+
+	iconErrs := make(IconErrors)
+	if len(owned) > 0 {
+		fetched, err := f.Fetcher.FetchIcons(ctx, missing)
+		fetchErrs, partial := errgo.Cause(err).(IconErrors)
+		abandoned := ctx.Err() != nil
+		f.mu.Lock()
+		for path, call := range owned {
+			call.icon, call.err, call.abandoned = fetched[path], err, abandoned
+			if partial {
+				// Share only the failure of this icon.
+				call.err = nil
+				if fetchErrs[path] != nil {
+					call.err = IconErrors{path: fetchErrs[path]}
+				}
+			}
+			delete(f.inflight, path)
+			if call.err == nil && call.icon != nil {
+				f.stats.Evictions += int64(f.icons.add(path, call.icon))
+			}
+			close(call.done)
+		}
+		f.mu.Unlock()
+		if err != nil && !partial {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	retry := &charm.BundleData{
+		Applications: make(map[string]*charm.ApplicationSpec),
+	}
+	for path, call := range shared {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, errgo.Notef(ctx.Err(), "cannot fetch icon for %q", path)
+		}
+		if call.err != nil && call.abandoned {
+			// The fetch failed after its caller gave up on
+			// it, so try again for this caller.
+			retry.Applications[paths[path]] = b.Applications[paths[path]]
+			delete(shared, path)
+			continue
+		}
+		if _, ok := call.err.(IconErrors); call.err != nil && !ok {
+			return nil, errgo.Mask(call.err, errgo.Any)
+		}
+	}
+	if len(retry.Applications) > 0 {
+		retried, err := f.FetchIcons(ctx, retry)
+		retryErrs, partial := errgo.Cause(err).(IconErrors)
+		if err != nil && !partial {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		for path, icon := range retried {
+			icons[path] = icon
+		}
+		for path, err := range retryErrs {
+			iconErrs[path] = err
+		}
+	}
+	for _, calls := range []map[string]*iconCall{owned, shared} {
+		for path, call := range calls {
+			if call.err != nil {
+				iconErrs[path] = call.err.(IconErrors)[path]
+			} else if call.icon != nil {
+				icons[path] = call.icon
+			}
+		}
+	}
+	if len(iconErrs) > 0 {
+		return icons, iconErrs
+	}
+	return icons, nil
+}
+
+// lruCache holds a bounded number of values, discarding the least
+// recently used when it is full. It is not safe for concurrent use.
+type lruCache struct {
+	max int
+
+	// items holds an element of list for each value.
+	items map[string]*list.Element
+
+	// list holds the values, most recently used first.
+	list *list.List
+}
+
+// lruEntry holds a value in an lruCache.
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// newLRUCache returns a new lruCache that holds up to max values.
+func newLRUCache(max int) *lruCache {
+	return &lruCache{
+		max:   max,
+		items: make(map[string]*list.Element),
+		list:  list.New(),
+	}
+}
+
+// get returns the value with the given key, marking it as the most
+// recently used.
+func (c *lruCache) get(key string) (interface{}, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.list.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// add adds or replaces the value with the given key, and returns the
+// number of values that were discarded to make room for it.
+func (c *lruCache) add(key string, value interface{}) int {
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.list.MoveToFront(e)
+		return 0
+	}
+	c.items[key] = c.list.PushFront(&lruEntry{
+		key:   key,
+		value: value,
+	})
+	n := 0
+	for c.list.Len() > c.max {
+		e := c.list.Back()
+		c.list.Remove(e)
+		delete(c.items, e.Value.(*lruEntry).key)
+		n++
+	}
+	return n
+}
+
+// len returns the number of values held.
+func (c *lruCache) len() int {
+	return c.list.Len()
+}
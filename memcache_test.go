@@ -0,0 +1,235 @@
+package jujusvg
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+func TestMemoryCacheFetcher(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	underlying := &pathFetcher{}
+	fetcher := &MemoryCacheFetcher{
+		Fetcher:  underlying,
+		MaxIcons: 3,
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.HasLen, 3)
+	c.Assert(fetcher.Stats(), qt.DeepEquals, CacheStats{
+		Misses: 3,
+		Icons:  3,
+	})
+
+	icons, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons["precise/mongodb-21"], qt.DeepEquals, []byte("<svg>precise/mongodb-21</svg>"))
+	c.Assert(fetcher.Stats(), qt.DeepEquals, CacheStats{
+		Hits:   3,
+		Misses: 3,
+		Icons:  3,
+	})
+
+	// Using mongodb again makes charmworld the least recently used,
+	// so it is evicted to make room for haproxy.
+	_, err = fetcher.FetchIcons(ctx, &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mongodb": {Charm: "cs:precise/mongodb-21"},
+			"es":      {Charm: "cs:~charming-devs/precise/elasticsearch-2"},
+			"haproxy": {Charm: "cs:precise/haproxy-35"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(fetcher.Stats(), qt.DeepEquals, CacheStats{
+		Hits:      5,
+		Misses:    4,
+		Evictions: 1,
+		Icons:     3,
+	})
+	underlying.fetched = nil
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(underlying.fetched, qt.DeepEquals, map[string]int{
+		"~juju-jitsu/precise/charmworld-58": 1,
+	})
+}
+
+func TestMemoryCacheFetcherShared(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	underlying := &blockingFetcher{
+		Fetcher: &pathFetcher{},
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	fetcher := &MemoryCacheFetcher{
+		Fetcher: underlying,
+	}
+	var wg sync.WaitGroup
+	fetch := func() {
+		defer wg.Done()
+		icons, err := fetcher.FetchIcons(ctx, b)
+		c.Check(err, qt.IsNil)
+		c.Check(icons, qt.HasLen, 3)
+	}
+	wg.Add(1)
+	go fetch()
+	<-underlying.started
+
+	// While the first fetch is in progress, the others wait for
+	// its results rather than fetching the icons again.
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go fetch()
+	}
+	for fetcher.Stats().Shared < 15 {
+		time.Sleep(time.Millisecond)
+	}
+	close(underlying.release)
+	wg.Wait()
+	c.Assert(underlying.Fetcher.(*pathFetcher).fetched, qt.DeepEquals, map[string]int{
+		"~charming-devs/precise/elasticsearch-2": 1,
+		"~juju-jitsu/precise/charmworld-58":      1,
+		"precise/mongodb-21":                     1,
+	})
+	c.Assert(fetcher.Stats(), qt.DeepEquals, CacheStats{
+		Misses: 3,
+		Shared: 15,
+		Icons:  3,
+	})
+}
+
+func TestMemoryCacheFetcherError(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	underlying := errFetcher("bad wolf")
+	fetcher := &MemoryCacheFetcher{
+		Fetcher: &underlying,
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, "bad wolf")
+	c.Assert(icons, qt.IsNil)
+
+	// Failures are not cached.
+	fetcher.Fetcher = &pathFetcher{}
+	icons, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icons, qt.HasLen, 3)
+}
+
+func TestMemoryCacheFetcherCancel(t *testing.T) {
+	c := qt.New(t)
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	underlying := &blockingFetcher{
+		Fetcher: &pathFetcher{},
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	defer close(underlying.release)
+	fetcher := &MemoryCacheFetcher{
+		Fetcher: underlying,
+	}
+	go fetcher.FetchIcons(context.Background(), b)
+	<-underlying.started
+
+	// A caller waiting for another's fetch stops when its context
+	// is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	icons, err := fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for ".*": context canceled`)
+	c.Assert(icons, qt.IsNil)
+}
+
+func TestMemoryCacheFetcherOwnerCancelled(t *testing.T) {
+	c := qt.New(t)
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	underlying := &blockingFetcher{
+		Fetcher: &ctxFetcher{
+			Fetcher: &pathFetcher{},
+		},
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	fetcher := &MemoryCacheFetcher{
+		Fetcher: underlying,
+	}
+	ownerCtx, cancel := context.WithCancel(context.Background())
+	ownerDone := make(chan error)
+	go func() {
+		_, err := fetcher.FetchIcons(ownerCtx, b)
+		ownerDone <- err
+	}()
+	<-underlying.started
+
+	type result struct {
+		icons map[string][]byte
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		icons, err := fetcher.FetchIcons(context.Background(), b)
+		done <- result{icons, err}
+	}()
+	for fetcher.Stats().Shared < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The caller that started the fetch gives up on it, but the
+	// caller sharing it fetches the icons itself.
+	cancel()
+	close(underlying.release)
+	c.Assert(<-ownerDone, qt.ErrorMatches, "cannot fetch icons: context canceled")
+	r := <-done
+	c.Assert(r.err, qt.IsNil)
+	c.Assert(r.icons, qt.HasLen, 3)
+	c.Assert(fetcher.Stats().Icons, qt.Equals, 3)
+}
+
+// ctxFetcher is an IconFetcher that fails if its context is done, and
+// otherwise calls Fetcher.
+type ctxFetcher struct {
+	Fetcher IconFetcher
+}
+
+func (f *ctxFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errgo.Notef(err, "cannot fetch icons")
+	}
+	return f.Fetcher.FetchIcons(ctx, b)
+}
+
+// blockingFetcher is an IconFetcher that signals on started each time
+// it is called, and then waits for release to be closed before calling
+// Fetcher.
+type blockingFetcher struct {
+	Fetcher IconFetcher
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingFetcher) FetchIcons(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	f.started <- struct{}{}
+	<-f.release
+	return f.Fetcher.FetchIcons(ctx, b)
+}
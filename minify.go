@@ -0,0 +1,152 @@
+package jujusvg
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/xml"
+)
+
+// MinifyIcons specifies that icons should be made smaller when they are
+// embedded in the canvas, without changing how they are drawn. Comments,
+// whitespace between elements and the namespace declarations left
+// unused once editor metadata has been removed are dropped, and numbers
+// in path data and point lists are rounded to the given number of
+// decimal places. If precision is negative, numbers are not rounded.
+func (c *Canvas) MinifyIcons(precision int) {
+	c.minify = &iconMinifier{
+		precision: precision,
+	}
+}
+
+// IconSize holds the size of an icon before and after it is processed
+// for inclusion in the SVG.
+type IconSize struct {
+	// Original holds the size in bytes of the icon as fetched.
+	Original int
+
+	// Embedded holds the size in bytes of the icon as embedded.
+	Embedded int
+}
+
+// IconSizes returns the sizes of the icons embedded in the SVG, keyed by
+// charm path, showing the savings made by sanitising and minifying them.
+// Icons that cannot be embedded are omitted.
+func (c *Canvas) IconSizes() map[string]IconSize {
+	sizes := make(map[string]IconSize)
+	for _, application := range c.applications {
+		if len(application.iconSrc) == 0 {
+			continue
+		}
+		if _, ok := sizes[application.iconKey()]; ok {
+			continue
+		}
+		opts := c.iconOptions()
+		opts.trustedURL = application.iconUrl
+		var buf bytes.Buffer
+		if _, err := processIcon(bytes.NewReader(application.iconSrc), &buf, "icon", opts); err != nil {
+			continue
+		}
+		sizes[application.iconKey()] = IconSize{
+			Original: len(application.iconSrc),
+			Embedded: buf.Len(),
+		}
+	}
+	return sizes
+}
+
+// iconOptions returns the options used to process icons for the canvas.
+// The trustedURL field is left for the caller to set.
+func (c *Canvas) iconOptions() iconOptions {
+	return iconOptions{
+		limits: c.limits(),
+		minify: c.minify,
+	}
+}
+
+// iconMinifier makes icons smaller without changing how they are drawn.
+type iconMinifier struct {
+	// precision holds the number of decimal places to which numbers
+	// in path data are rounded, or a negative number if they are
+	// not rounded.
+	precision int
+}
+
+// textElements holds the elements whose text content is significant.
+var textElements = stringSet("desc", "style", "text", "textPath", "title", "tspan")
+
+// usedNamespaces holds the namespaces that may still be used in an icon
+// once it has been sanitised.
+var usedNamespaces = stringSet(svgNamespace, xlinkNamespace)
+
+// attrs returns the given attributes without unused namespace
+// declarations, and with numbers in geometry rounded.
+func (m *iconMinifier) attrs(attrs []xml.Attr) []xml.Attr {
+	result := attrs[:0]
+	for _, attr := range attrs {
+		switch {
+		case attr.Name.Space == "xmlns" && !usedNamespaces[attr.Value]:
+			continue
+		case attr.Name.Space == "" && attr.Name.Local == "points":
+			attr.Value = m.numbers(attr.Value)
+		case attr.Name.Space == "" && attr.Name.Local == "d" && !strings.ContainsAny(attr.Value, "aA"):
+			// The flags of arc commands may be written without
+			// separators, so path data containing arcs is left
+			// alone rather than risk misreading it.
+			attr.Value = m.numbers(attr.Value)
+		}
+		result = append(result, attr)
+	}
+	return result
+}
+
+// text returns the given character data found within the given element,
+// or nil if it is not needed.
+func (m *iconMinifier) text(parent string, text xml.CharData) xml.CharData {
+	if !textElements[parent] && len(bytes.TrimSpace(text)) == 0 {
+		return nil
+	}
+	return text
+}
+
+// numberRegexp matches a number in path data or a point list.
+var numberRegexp = regexp.MustCompile(`-?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?`)
+
+// numbers returns the given path data or point list with its numbers
+// rounded to m.precision decimal places.
+func (m *iconMinifier) numbers(s string) string {
+	if m.precision < 0 {
+		return s
+	}
+	var buf strings.Builder
+	last := 0
+	for _, loc := range numberRegexp.FindAllStringIndex(s, -1) {
+		buf.WriteString(s[last:loc[0]])
+		adjacent := last == loc[0] && loc[0] > 0
+		last = loc[1]
+		v, err := strconv.ParseFloat(s[loc[0]:loc[1]], 64)
+		if err != nil {
+			buf.WriteString(s[loc[0]:loc[1]])
+			continue
+		}
+		scale := math.Pow(10, float64(m.precision))
+		v = math.Round(v*scale) / scale
+		if v == 0 {
+			// Avoid writing -0.
+			v = 0
+		}
+		n := strconv.FormatFloat(v, 'f', -1, 64)
+		if adjacent && n[0] != '-' {
+			// The number, such as "-0.001" or ".5", was
+			// separated from the previous one only by its sign
+			// or decimal point, which may have been lost.
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(n)
+	}
+	buf.WriteString(s[last:])
+	return buf.String()
+}
@@ -0,0 +1,157 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+	"github.com/juju/xml"
+)
+
+const inkscapeIcon = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<!-- Created with Inkscape (http://www.inkscape.org/) -->
+<svg
+   xmlns:dc="http://purl.org/dc/elements/1.1/"
+   xmlns:cc="http://creativecommons.org/ns#"
+   xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+   xmlns:svg="http://www.w3.org/2000/svg"
+   xmlns="http://www.w3.org/2000/svg"
+   xmlns:xlink="http://www.w3.org/1999/xlink"
+   xmlns:sodipodi="http://sodipodi.sourceforge.net/DTD/sodipodi-0.dtd"
+   xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape"
+   width="96"
+   height="96"
+   inkscape:version="0.48+devel r12274"
+   sodipodi:docname="icon.svg">
+  <sodipodi:namedview
+     id="base"
+     inkscape:zoom="4" />
+  <metadata
+     id="metadata7">
+    <rdf:RDF>
+      <cc:Work
+         rdf:about="">
+        <dc:format>image/svg+xml</dc:format>
+      </cc:Work>
+    </rdf:RDF>
+  </metadata>
+  <g
+     inkscape:label="Layer 1"
+     id="layer1">
+    <!-- The background. -->
+    <path
+       d="M 0.12345,95.98765 L 48.000001,-0.0001 Z"
+       id="path1"
+       inkscape:connector-curvature="0" />
+    <polygon points="1.23456,2.5 3.14159,4" />
+    <text xml:space="preserve"> Juju  charm </text>
+  </g>
+</svg>
+`
+
+func TestMinifyIcon(t *testing.T) {
+	c := qt.New(t)
+
+	var full, minified bytes.Buffer
+	_, err := processIcon(strings.NewReader(inkscapeIcon), &full, "icon-1", iconOptions{})
+	c.Assert(err, qt.IsNil)
+	_, err = processIcon(strings.NewReader(inkscapeIcon), &minified, "icon-1", iconOptions{
+		minify: &iconMinifier{
+			precision: 2,
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(minified.String(), qt.Equals, `<svg xmlns:xlink="http://www.w3.org/1999/xlink" xmlns="http://www.w3.org/2000/svg" xmlns:svg="http://www.w3.org/2000/svg" width="96" height="96" id="icon-1">`+
+		`<g id="icon-1-layer1">`+
+		`<path d="M 0.12,95.99 L 48,0 Z" id="icon-1-path1"></path>`+
+		`<polygon points="1.23,2.5 3.14,4"></polygon>`+
+		`<text xml:space="preserve"> Juju  charm </text>`+
+		`</g></svg>`)
+	c.Assert(minified.Len() < full.Len(), qt.Equals, true)
+}
+
+func TestMinifyNumbers(t *testing.T) {
+	c := qt.New(t)
+
+	tests := []struct {
+		precision int
+		in        string
+		out       string
+	}{{
+		precision: 3,
+		in:        "M1.23456-7.0001L.5,.25e1z",
+		out:       "M1.235-7L0.5,2.5z",
+	}, {
+		precision: 0,
+		in:        "M 1.4 -0.4 h 100.5",
+		out:       "M 1 0 h 101",
+	}, {
+		precision: 1,
+		in:        "M1.04.5",
+		out:       "M1 0.5",
+	}, {
+		precision: 2,
+		in:        "M10-0.001 5",
+		out:       "M10 0 5",
+	}, {
+		precision: 2,
+		in:        "M10-0.004-3",
+		out:       "M10 0-3",
+	}, {
+		precision: 0,
+		in:        "M10-0.4,5 1.5.5",
+		out:       "M10 0,5 2 1",
+	}, {
+		precision: 1,
+		in:        "M1.5.25-.5",
+		out:       "M1.5 0.3-0.5",
+	}, {
+		precision: -1,
+		in:        "M1.23456 7",
+		out:       "M1.23456 7",
+	}}
+	for _, test := range tests {
+		m := &iconMinifier{
+			precision: test.precision,
+		}
+		c.Check(m.numbers(test.in), qt.Equals, test.out, qt.Commentf("%q", test.in))
+	}
+
+	// Path data with arcs is not changed.
+	m := &iconMinifier{
+		precision: 1,
+	}
+	c.Assert(m.attrs([]xml.Attr{{
+		Name:  xml.Name{Local: "d"},
+		Value: "M1.23 4a1 1 0 01.5.5",
+	}})[0].Value, qt.Equals, "M1.23 4a1 1 0 01.5.5")
+}
+
+func TestIconSizes(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	cvs, err := NewFromBundle(ctx, b, iconURL, IconMap{
+		"precise/mongodb-21": []byte(inkscapeIcon),
+	})
+	c.Assert(err, qt.IsNil)
+	sizes := cvs.IconSizes()
+	c.Assert(sizes, qt.HasLen, 1)
+	size := sizes["precise/mongodb-21"]
+	c.Assert(size.Original, qt.Equals, len(inkscapeIcon))
+
+	cvs.MinifyIcons(2)
+	minified := cvs.IconSizes()["precise/mongodb-21"]
+	c.Assert(minified.Original, qt.Equals, len(inkscapeIcon))
+	c.Assert(minified.Embedded < size.Embedded, qt.Equals, true)
+
+	// The minified icon is embedded when the canvas is drawn.
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), qt.Contains, `<path d="M 0.12,95.99 L 48,0 Z" id="icon-1-path1"></path>`)
+}
@@ -0,0 +1,265 @@
+package jujusvg
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+// A StatusSource provides the status of a running model.
+type StatusSource interface {
+	ModelStatus(context.Context) (*ModelStatus, error)
+}
+
+// ModelStatus holds the parts of the status of a model needed to draw it.
+type ModelStatus struct {
+	// Applications holds an entry for each application in the
+	// model, indexed by application name.
+	Applications map[string]*ApplicationStatus
+
+	// Relations holds a slice of 2-element slices, each
+	// specifying a relation between two applications, with each
+	// endpoint specified as in charm.BundleData.Relations.
+	Relations [][]string
+}
+
+// ApplicationStatus holds the status of a single application.
+type ApplicationStatus struct {
+	// Charm holds a reference to the application's charm, as
+	// used in a bundle.
+	Charm string
+
+	// Channel holds the channel of the application's charm, if
+	// known.
+	Channel string
+
+	// Annotations holds the application's annotations. If these
+	// include gui-x and gui-y, they are used to position the
+	// application.
+	Annotations map[string]string
+
+	// Units holds the names of the application's units.
+	Units []string
+}
+
+// NewFromModel returns a new Canvas that can be used to generate a
+// graphical representation of the model whose status is provided by
+// src. The iconURL and fetcher arguments are used as for NewFromBundle.
+func NewFromModel(ctx context.Context, src StatusSource, iconURL func(context.Context, *charm.URL) (string, error), fetcher IconFetcher) (*Canvas, error) {
+	status, err := src.ModelStatus(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return NewFromBundle(ctx, status.bundleData(), iconURL, fetcher)
+}
+
+// bundleData returns a bundle describing the applications and relations
+// of the model, so that it can be drawn in the same way as a bundle.
+// Relations involving applications outside the model, such as those
+// consumed from offers, are omitted.
+func (s *ModelStatus) bundleData() *charm.BundleData {
+	b := &charm.BundleData{
+		Applications: make(map[string]*charm.ApplicationSpec, len(s.Applications)),
+	}
+	for name, app := range s.Applications {
+		b.Applications[name] = &charm.ApplicationSpec{
+			Charm:       app.Charm,
+			Channel:     app.Channel,
+			NumUnits:    len(app.Units),
+			Annotations: app.Annotations,
+		}
+	}
+	for _, relation := range s.Relations {
+		if len(relation) != 2 {
+			continue
+		}
+		if b.Applications[endpointApplication(relation[0])] == nil || b.Applications[endpointApplication(relation[1])] == nil {
+			continue
+		}
+		b.Relations = append(b.Relations, relation)
+	}
+	return b
+}
+
+// StatusFile is a StatusSource that reads the output of
+// `juju status --format=json` from a file.
+type StatusFile struct {
+	// Path holds the path of the file.
+	Path string
+}
+
+// ModelStatus implements StatusSource.ModelStatus.
+func (f *StatusFile) ModelStatus(ctx context.Context) (*ModelStatus, error) {
+	r, err := os.Open(f.Path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open status file")
+	}
+	defer r.Close()
+	status, err := ReadStatus(r)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read status from %s", f.Path)
+	}
+	return status, nil
+}
+
+// jujuStatus holds the parts of the output of `juju status --format=json`
+// that are used by ReadStatus.
+type jujuStatus struct {
+	Applications map[string]*jujuApplicationStatus `json:"applications"`
+}
+
+// jujuApplicationStatus holds the parts of the status of a single
+// application that are used by ReadStatus.
+type jujuApplicationStatus struct {
+	Charm        string              `json:"charm"`
+	CharmOrigin  string              `json:"charm-origin"`
+	CharmName    string              `json:"charm-name"`
+	CharmRev     *int                `json:"charm-rev"`
+	CharmChannel string              `json:"charm-channel"`
+	Series       string              `json:"series"`
+	Relations    map[string][]string `json:"relations"`
+	Units        map[string]struct {
+		Subordinates map[string]struct{} `json:"subordinates"`
+	} `json:"units"`
+}
+
+// charmRef returns a reference to the application's charm. Older
+// versions of Juju report the charm's URL, which is used as it is.
+// Newer versions report the charm's name along with its origin and
+// revision, from which a reference is built. Charmhub charms are
+// referred to by name alone, as their icons are looked up by name
+// and channel.
+func (app *jujuApplicationStatus) charmRef() string {
+	if strings.Contains(app.Charm, ":") {
+		return app.Charm
+	}
+	name := app.CharmName
+	if name == "" {
+		name = app.Charm
+	}
+	var schema string
+	switch app.CharmOrigin {
+	case "charmhub":
+		return charmhubSchema + ":" + name
+	case "charmstore":
+		schema = "cs"
+	case "local":
+		schema = "local"
+	default:
+		return app.Charm
+	}
+	ref := schema + ":" + name
+	if app.Series != "" {
+		ref = schema + ":" + app.Series + "/" + name
+	}
+	if app.CharmRev != nil {
+		ref += "-" + strconv.Itoa(*app.CharmRev)
+	}
+	return ref
+}
+
+// ReadStatus reads the output of `juju status --format=json` from r.
+// Charm references are read from either the charm URL reported by
+// older versions of Juju, or the charm name, origin, revision and
+// channel reported by newer ones.
+//
+// The status output records the relations of each application as a map
+// from endpoint name to the names of the related applications, without
+// the endpoint used by the other side. Relations are reconstructed by
+// matching each endpoint with one on the related application that
+// refers back to it, in alphabetical order; endpoints that cannot be
+// matched are omitted.
+func ReadStatus(r io.Reader) (*ModelStatus, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var js jujuStatus
+	if err := json.Unmarshal(data, &js); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal status")
+	}
+	status := &ModelStatus{
+		Applications: make(map[string]*ApplicationStatus, len(js.Applications)),
+	}
+	// Units of subordinate applications are reported alongside the
+	// units of the applications they are subordinate to.
+	subordinateUnits := make(map[string][]string)
+	for _, app := range js.Applications {
+		for _, unit := range app.Units {
+			for name := range unit.Subordinates {
+				subordinate := strings.SplitN(name, "/", 2)[0]
+				subordinateUnits[subordinate] = append(subordinateUnits[subordinate], name)
+			}
+		}
+	}
+	names := make([]string, 0, len(js.Applications))
+	for name, app := range js.Applications {
+		names = append(names, name)
+		units := subordinateUnits[name]
+		for unit := range app.Units {
+			units = append(units, unit)
+		}
+		sort.Strings(units)
+		status.Applications[name] = &ApplicationStatus{
+			Charm:   app.charmRef(),
+			Channel: app.CharmChannel,
+			Units:   units,
+		}
+	}
+	sort.Strings(names)
+
+	// related holds, for each pair of applications, the endpoints
+	// of the first that relate to the second.
+	type pair struct{ from, to string }
+	related := make(map[pair][]string)
+	for _, name := range names {
+		relations := js.Applications[name].Relations
+		endpoints := make([]string, 0, len(relations))
+		for endpoint := range relations {
+			endpoints = append(endpoints, endpoint)
+		}
+		sort.Strings(endpoints)
+		for _, endpoint := range endpoints {
+			for _, other := range relations[endpoint] {
+				if other == name {
+					// Peer relations are not drawn.
+					continue
+				}
+				related[pair{name, other}] = append(related[pair{name, other}], endpoint)
+			}
+		}
+	}
+	for _, name := range names {
+		var others []string
+		for p := range related {
+			if p.from == name && p.to > name {
+				others = append(others, p.to)
+			}
+		}
+		sort.Strings(others)
+		for _, other := range others {
+			ours, theirs := related[pair{name, other}], related[pair{other, name}]
+			for i := 0; i < len(ours) && i < len(theirs); i++ {
+				status.Relations = append(status.Relations, []string{
+					name + ":" + ours[i],
+					other + ":" + theirs[i],
+				})
+			}
+		}
+	}
+	return status, nil
+}
+
+// endpointApplication returns the application name part of a relation
+// endpoint of the form application[:relation].
+func endpointApplication(endpoint string) string {
+	return strings.SplitN(endpoint, ":", 2)[0]
+}
@@ -0,0 +1,256 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var status = `{
+  "model": {"name": "default", "type": "iaas"},
+  "machines": {},
+  "applications": {
+    "mysql": {
+      "charm": "cs:xenial/mysql-58",
+      "series": "xenial",
+      "relations": {
+        "cluster": ["mysql"],
+        "db": ["wordpress"],
+        "juju-info": ["nrpe"]
+      },
+      "units": {
+        "mysql/1": {
+          "subordinates": {"nrpe/1": {}}
+        },
+        "mysql/0": {
+          "subordinates": {"nrpe/0": {}}
+        }
+      }
+    },
+    "wordpress": {
+      "charm": "cs:xenial/wordpress-5",
+      "series": "xenial",
+      "relations": {
+        "db": ["mysql"],
+        "website": ["haproxy"]
+      },
+      "units": {
+        "wordpress/0": {}
+      }
+    },
+    "nrpe": {
+      "charm": "cs:xenial/nrpe-60",
+      "series": "xenial",
+      "subordinate-to": ["mysql"],
+      "relations": {
+        "general-info": ["mysql"]
+      }
+    }
+  }
+}
+`
+
+func TestReadStatus(t *testing.T) {
+	c := qt.New(t)
+
+	st, err := ReadStatus(strings.NewReader(status))
+	c.Assert(err, qt.IsNil)
+	c.Assert(st, qt.DeepEquals, &ModelStatus{
+		Applications: map[string]*ApplicationStatus{
+			"mysql": {
+				Charm: "cs:xenial/mysql-58",
+				Units: []string{"mysql/0", "mysql/1"},
+			},
+			"nrpe": {
+				Charm: "cs:xenial/nrpe-60",
+				Units: []string{"nrpe/0", "nrpe/1"},
+			},
+			"wordpress": {
+				Charm: "cs:xenial/wordpress-5",
+				Units: []string{"wordpress/0"},
+			},
+		},
+		// The peer relation and the relation to the unknown
+		// haproxy application are omitted.
+		Relations: [][]string{
+			{"mysql:juju-info", "nrpe:general-info"},
+			{"mysql:db", "wordpress:db"},
+		},
+	})
+}
+
+// currentStatus holds status in the format used by current versions of
+// Juju, which report the charm name and origin separately.
+var currentStatus = `{
+  "model": {"name": "default", "type": "iaas"},
+  "machines": {},
+  "applications": {
+    "postgresql": {
+      "charm": "postgresql",
+      "base": {"name": "ubuntu", "channel": "22.04"},
+      "charm-origin": "charmhub",
+      "charm-name": "postgresql",
+      "charm-rev": 345,
+      "charm-channel": "14/stable",
+      "relations": {
+        "database": ["indico"]
+      },
+      "units": {
+        "postgresql/0": {}
+      }
+    },
+    "indico": {
+      "charm": "indico",
+      "base": {"name": "ubuntu", "channel": "22.04"},
+      "charm-origin": "local",
+      "charm-name": "indico",
+      "charm-rev": 0,
+      "relations": {
+        "database": ["postgresql"]
+      },
+      "units": {
+        "indico/0": {}
+      }
+    },
+    "mysql": {
+      "charm": "mysql",
+      "series": "xenial",
+      "charm-origin": "charmstore",
+      "charm-name": "mysql",
+      "charm-rev": 58,
+      "charm-channel": "stable",
+      "units": {
+        "mysql/0": {}
+      }
+    }
+  }
+}
+`
+
+func TestReadStatusCurrentFormat(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	st, err := ReadStatus(strings.NewReader(currentStatus))
+	c.Assert(err, qt.IsNil)
+	c.Assert(st, qt.DeepEquals, &ModelStatus{
+		Applications: map[string]*ApplicationStatus{
+			"indico": {
+				Charm: "local:indico-0",
+				Units: []string{"indico/0"},
+			},
+			"mysql": {
+				Charm:   "cs:xenial/mysql-58",
+				Channel: "stable",
+				Units:   []string{"mysql/0"},
+			},
+			"postgresql": {
+				Charm:   "ch:postgresql",
+				Channel: "14/stable",
+				Units:   []string{"postgresql/0"},
+			},
+		},
+		Relations: [][]string{
+			{"indico:database", "postgresql:database"},
+		},
+	})
+
+	// The status can be drawn.
+	cvs, err := NewFromBundle(ctx, st.bundleData(), iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+	var charms []string
+	for _, application := range cvs.Scene().Applications {
+		charms = append(charms, application.Charm)
+	}
+	c.Assert(charms, qt.DeepEquals, []string{"indico-0", "xenial/mysql-58", "ch:postgresql"})
+	c.Assert(st.bundleData().Applications["postgresql"].Channel, qt.Equals, "14/stable")
+}
+
+func TestReadStatusError(t *testing.T) {
+	c := qt.New(t)
+
+	st, err := ReadStatus(strings.NewReader("bad-wolf"))
+	c.Assert(err, qt.ErrorMatches, "cannot unmarshal status: .*")
+	c.Assert(st, qt.IsNil)
+}
+
+func TestNewFromModel(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	path := filepath.Join(c.Mkdir(), "status.json")
+	err := ioutil.WriteFile(path, []byte(status), 0644)
+	c.Assert(err, qt.IsNil)
+
+	cvs, err := NewFromModel(ctx, &StatusFile{Path: path}, iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+	c.Assert(cvs.Scene(), qt.DeepEquals, &Scene{
+		Version: SceneVersion,
+		Width:   721,
+		Height:  361,
+		Applications: []SceneApplication{{
+			Name:    "mysql",
+			Charm:   "xenial/mysql-58",
+			X:       0,
+			Y:       0,
+			Width:   180,
+			Height:  180,
+			IconURL: "http://0.1.2.3/xenial/mysql-58.svg",
+		}, {
+			Name:    "nrpe",
+			Charm:   "xenial/nrpe-60",
+			X:       270,
+			Y:       90,
+			Width:   180,
+			Height:  180,
+			IconURL: "http://0.1.2.3/xenial/nrpe-60.svg",
+		}, {
+			Name:    "wordpress",
+			Charm:   "xenial/wordpress-5",
+			X:       540,
+			Y:       180,
+			Width:   180,
+			Height:  180,
+			IconURL: "http://0.1.2.3/xenial/wordpress-5.svg",
+		}},
+		Relations: []SceneRelation{{
+			Name:         "mysql:juju-info nrpe:general-info",
+			Endpoints:    [2]string{"mysql:juju-info", "nrpe:general-info"},
+			Applications: [2]string{"mysql", "nrpe"},
+			Line:         [2]ScenePoint{{90, 90}, {360, 180}},
+			Connectors:   [2]ScenePoint{{175, 118}, {274, 151}},
+			Health:       ScenePoint{217, 127},
+		}, {
+			Name:         "mysql:db wordpress:db",
+			Endpoints:    [2]string{"mysql:db", "wordpress:db"},
+			Applications: [2]string{"mysql", "wordpress"},
+			Line:         [2]ScenePoint{{90, 90}, {630, 270}},
+			Connectors:   [2]ScenePoint{{175, 118}, {544, 241}},
+			Health:       ScenePoint{352, 172},
+		}},
+	})
+
+	// Rendering is deterministic.
+	var buf1, buf2 bytes.Buffer
+	cvs.Marshal(&buf1)
+	cvs, err = NewFromModel(ctx, &StatusFile{Path: path}, iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+	cvs.Marshal(&buf2)
+	c.Assert(buf1.String(), qt.Equals, buf2.String())
+}
+
+func TestNewFromModelBadFile(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	cvs, err := NewFromModel(ctx, &StatusFile{Path: filepath.Join(c.Mkdir(), "missing")}, iconURL, nil)
+	c.Assert(err, qt.ErrorMatches, "cannot open status file: .*")
+	c.Assert(cvs, qt.IsNil)
+}
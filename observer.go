@@ -0,0 +1,66 @@
+package jujusvg
+
+import (
+	"context"
+	"time"
+)
+
+// A FetchObserver is notified of each icon fetched by a fetcher, for
+// instance to record metrics or traces. Its methods may be called
+// concurrently.
+type FetchObserver interface {
+	// FetchStarted is called when the fetcher starts to fetch the
+	// icon for the charm with the given path. The returned context
+	// is used for the fetch and passed to FetchDone, so that it can
+	// carry a trace span, for instance.
+	FetchStarted(ctx context.Context, charmPath string) context.Context
+
+	// FetchDone is called when the fetch has finished.
+	FetchDone(ctx context.Context, event FetchEvent)
+}
+
+// FetchEvent describes a finished icon fetch.
+type FetchEvent struct {
+	// CharmPath holds the path of the charm whose icon was fetched.
+	CharmPath string
+
+	// URL holds the URL from which the icon was fetched, if any.
+	URL string
+
+	// CacheHit holds whether the icon was served from a cache,
+	// including when an HTTP server reports that a cached icon has
+	// not been modified.
+	CacheHit bool
+
+	// Bytes holds the size of the icon in bytes.
+	Bytes int
+
+	// Duration holds how long the fetch took.
+	Duration time.Duration
+
+	// StatusCode holds the status code of the last HTTP response,
+	// or zero if there was none.
+	StatusCode int
+
+	// Attempts holds the number of HTTP requests made.
+	Attempts int
+
+	// Err holds the error that caused the fetch to fail, if any.
+	Err error
+}
+
+// observeCacheHit notifies o, if it is not nil, that the given icon for
+// the charm with the given path was found in a cache by a lookup that
+// started at the given time.
+func observeCacheHit(ctx context.Context, o FetchObserver, charmPath string, icon []byte, start time.Time) {
+	if o == nil {
+		return
+	}
+	ctx = o.FetchStarted(ctx, charmPath)
+	o.FetchDone(ctx, FetchEvent{
+		CharmPath: charmPath,
+		CacheHit:  true,
+		Bytes:     len(icon),
+		Duration:  time.Since(start),
+	})
+}
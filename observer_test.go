@@ -0,0 +1,160 @@
+package jujusvg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+type observerKey struct{}
+
+// recordingObserver is a FetchObserver that records the events it
+// receives, keyed by charm path.
+type recordingObserver struct {
+	mu      sync.Mutex
+	started map[string]int
+	events  map[string]FetchEvent
+}
+
+func (o *recordingObserver) FetchStarted(ctx context.Context, charmPath string) context.Context {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.started == nil {
+		o.started = make(map[string]int)
+	}
+	o.started[charmPath]++
+	return context.WithValue(ctx, observerKey{}, charmPath)
+}
+
+func (o *recordingObserver) FetchDone(ctx context.Context, event FetchEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if ctx.Value(observerKey{}) != event.CharmPath {
+		panic("context not passed to FetchDone")
+	}
+	if o.events == nil {
+		o.events = make(map[string]FetchEvent)
+	}
+	o.events[event.CharmPath] = event
+}
+
+func TestHTTPFetcherObserver(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	failures := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(r.URL.Path, "charmworld"):
+			http.NotFound(w, r)
+		case strings.Contains(r.URL.Path, "mongodb") && failures == 0:
+			failures++
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprint(w, "<svg>icon</svg>")
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	observer := &recordingObserver{}
+	fetcher := HTTPFetcher{
+		IconURL: func(_ context.Context, ref *charm.URL) (string, error) {
+			return ts.URL + "/" + ref.Path() + ".svg", nil
+		},
+		Retries:    1,
+		RetryDelay: 1,
+		Partial:    true,
+		Cache:      &MemoryHTTPCache{},
+		Observer:   observer,
+	}
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.ErrorMatches, `cannot fetch icon for "~juju-jitsu/precise/charmworld-58": .*`)
+	c.Assert(observer.started, qt.DeepEquals, map[string]int{
+		"~charming-devs/precise/elasticsearch-2": 1,
+		"~juju-jitsu/precise/charmworld-58":      1,
+		"precise/mongodb-21":                     1,
+	})
+	ev := observer.events["precise/mongodb-21"]
+	c.Assert(ev.URL, qt.Equals, ts.URL+"/precise/mongodb-21.svg")
+	c.Assert(ev.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(ev.Attempts, qt.Equals, 2)
+	c.Assert(ev.Bytes, qt.Equals, len("<svg>icon</svg>"))
+	c.Assert(ev.CacheHit, qt.Equals, false)
+	c.Assert(ev.Duration > 0, qt.Equals, true)
+	c.Assert(ev.Err, qt.IsNil)
+
+	ev = observer.events["~juju-jitsu/precise/charmworld-58"]
+	c.Assert(ev.StatusCode, qt.Equals, http.StatusNotFound)
+	c.Assert(ev.Attempts, qt.Equals, 1)
+	c.Assert(ev.Err, qt.ErrorMatches, `cannot retrieve icon from .*: 404 Not Found`)
+
+	// Icons that have not been modified are reported as cache hits.
+	_, err = fetcher.FetchIcons(ctx, b)
+	c.Assert(err, qt.Not(qt.IsNil))
+	ev = observer.events["precise/mongodb-21"]
+	c.Assert(ev.StatusCode, qt.Equals, http.StatusNotModified)
+	c.Assert(ev.CacheHit, qt.Equals, true)
+	c.Assert(ev.Bytes, qt.Equals, len("<svg>icon</svg>"))
+}
+
+func TestCacheFetcherObserver(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	for _, test := range []struct {
+		about   string
+		fetcher func(FetchObserver) IconFetcher
+	}{{
+		about: "memory",
+		fetcher: func(o FetchObserver) IconFetcher {
+			return &MemoryCacheFetcher{
+				Fetcher:  &pathFetcher{},
+				Observer: o,
+			}
+		},
+	}, {
+		about: "disk",
+		fetcher: func(o FetchObserver) IconFetcher {
+			return &DiskCacheFetcher{
+				Fetcher:  &pathFetcher{},
+				Dir:      c.Mkdir(),
+				Observer: o,
+			}
+		},
+	}} {
+		c.Run(test.about, func(c *qt.C) {
+			observer := &recordingObserver{}
+			fetcher := test.fetcher(observer)
+			_, err := fetcher.FetchIcons(ctx, b)
+			c.Assert(err, qt.IsNil)
+			c.Assert(observer.events, qt.HasLen, 0)
+
+			_, err = fetcher.FetchIcons(ctx, b)
+			c.Assert(err, qt.IsNil)
+			c.Assert(observer.events, qt.HasLen, 3)
+			ev := observer.events["precise/mongodb-21"]
+			c.Assert(ev.CacheHit, qt.Equals, true)
+			c.Assert(ev.Bytes, qt.Equals, len("<svg>precise/mongodb-21</svg>"))
+		})
+	}
+}
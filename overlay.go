@@ -0,0 +1,457 @@
+package jujusvg
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+// FetchIconsForSources uses fetcher to fetch the icons of every charm
+// that may appear in the bundle produced by merging the given sources
+// with charm.ReadAndMergeBundleData. This includes the charms of the
+// applications in the base bundle and in every overlay, even those that
+// a later overlay changes or removes. Each charm is fetched only once.
+// As with charm.ReadAndMergeBundleData, relative paths of local charms
+// are resolved against the base path of the source that holds them.
+//
+// SAAS entries do not name the charm behind the offer they consume, so
+// saasCharms may give a charm for each SAAS entry, keyed by its name.
+// The icons of those charms are fetched for the SAAS entries that appear
+// in the sources and returned under the keys given by SaasIconKey as
+// well as under their charm paths.
+func FetchIconsForSources(ctx context.Context, fetcher IconFetcher, saasCharms map[string]string, sources ...charm.BundleDataSource) (IconMap, error) {
+	// specs holds an application using each charm, keyed by charm
+	// reference. The application's other details, such as its
+	// channel, may be needed to fetch the icon.
+	specs := make(map[string]*charm.ApplicationSpec)
+	// saasPaths holds the charm path of each SAAS entry, keyed by
+	// its name.
+	saasPaths := make(map[string]string)
+	for _, src := range sources {
+		if src == nil {
+			continue
+		}
+		for _, part := range src.Parts() {
+			if part.Data == nil {
+				continue
+			}
+			for _, app := range part.Data.Applications {
+				if app == nil || app.Charm == "" {
+					continue
+				}
+				ref := app.Charm
+				if strings.HasPrefix(ref, ".") {
+					path, err := filepath.Abs(filepath.Join(src.BasePath(), ref))
+					if err != nil {
+						return nil, errgo.Notef(err, "cannot resolve charm path %q", ref)
+					}
+					ref = path
+				}
+				if specs[ref] == nil {
+					app1 := *app
+					app1.Charm = ref
+					specs[ref] = &app1
+				}
+			}
+			for name := range part.Data.Saas {
+				ref := saasCharms[name]
+				if ref == "" {
+					continue
+				}
+				_, path, err := parseCharm(ref)
+				if err != nil {
+					return nil, errgo.Notef(err, "cannot parse charm %q for SAAS entry %q", ref, name)
+				}
+				saasPaths[name] = path
+				if specs[ref] == nil {
+					specs[ref] = &charm.ApplicationSpec{
+						Charm: ref,
+					}
+				}
+			}
+		}
+	}
+	refs := make([]string, 0, len(specs))
+	for ref := range specs {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	// Fetch all the icons at once with a bundle holding an
+	// application for each charm.
+	b := &charm.BundleData{
+		Applications: make(map[string]*charm.ApplicationSpec, len(refs)),
+	}
+	for i, ref := range refs {
+		b.Applications[fmt.Sprintf("application-%d", i)] = specs[ref]
+	}
+	icons, err := fetcher.FetchIcons(ctx, b)
+	if _, ok := errgo.Cause(err).(IconErrors); err != nil && !ok {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	// Copy the icons rather than adding to them, as some fetchers,
+	// such as IconMap, return icons that belong to the caller.
+	result := make(IconMap, len(icons)+len(saasPaths))
+	for path, icon := range icons {
+		result[path] = icon
+	}
+	for name, path := range saasPaths {
+		if icon := icons[path]; icon != nil {
+			result[SaasIconKey(name)] = icon
+		}
+	}
+	return result, err
+}
+
+// overlayColors holds the colours used to highlight the changes made by
+// each overlay. They are reused in turn when there are more overlays.
+var overlayColors = []string{
+	"#38b44a",
+	"#19b6ee",
+	"#efb73e",
+	"#772953",
+	"#e95420",
+	"#335280",
+}
+
+// OverlayOptions holds options for NewFromBundleOverlays.
+type OverlayOptions struct {
+	// Names optionally holds a name for each overlay, used in the
+	// legend. By default, overlays are named "Overlay 1", "Overlay 2"
+	// and so on.
+	Names []string
+
+	// Highlight specifies that the applications and relations added,
+	// changed or removed by each overlay are highlighted in a colour
+	// of its own and described by a legend. Removed applications and
+	// relations are drawn faded at their old positions. When an item
+	// is changed by several overlays, the last one is shown.
+	Highlight bool
+}
+
+// NewFromBundleOverlays returns a new Canvas showing the bundle produced
+// by merging the given sources with charm.ReadAndMergeBundleData. The
+// first part of the first source is the base bundle, and every later
+// part, whether in the same source or a later one, is an overlay applied
+// in turn. The differences made by each overlay, including any changes
+// to application options, are also returned, one for each overlay. The
+// sources are not changed.
+//
+// The iconURL and fetcher arguments are used as for NewFromBundle. As
+// applications removed by an overlay may be drawn, a fetcher returned by
+// FetchIconsForSources is a good choice.
+func NewFromBundleOverlays(ctx context.Context, sources []charm.BundleDataSource, opts OverlayOptions, iconURL func(context.Context, *charm.URL) (string, error), fetcher IconFetcher) (*Canvas, []*BundleDiff, error) {
+	var parts []*overlayPart
+	for _, src := range sources {
+		if src == nil {
+			continue
+		}
+		for _, part := range src.Parts() {
+			parts = append(parts, &overlayPart{
+				src:  src,
+				part: part,
+			})
+		}
+	}
+	if len(parts) == 0 {
+		return nil, nil, errgo.Newf("no bundle found")
+	}
+	if len(opts.Names) > 0 && len(opts.Names) != len(parts)-1 {
+		return nil, nil, errgo.Newf("got %d names for %d overlays", len(opts.Names), len(parts)-1)
+	}
+	// Merge the base bundle with each overlay in turn, keeping the
+	// bundle as it was before the overlay so that the overlay's
+	// changes can be found.
+	var (
+		merged  *charm.BundleData
+		diffs   []*BundleDiff
+		removed []*charm.BundleData
+	)
+	for i := range parts {
+		b, err := mergeParts(parts[:i+1])
+		if err != nil {
+			if i == 0 {
+				return nil, nil, errgo.Notef(err, "cannot read base bundle")
+			}
+			return nil, nil, errgo.Notef(err, "cannot apply overlay %s", overlayName(opts, i-1))
+		}
+		if i > 0 {
+			diffs = append(diffs, DiffBundles(merged, b))
+			removed = append(removed, merged)
+		}
+		merged = b
+	}
+	if err := verifyBundle(merged); err != nil {
+		return nil, nil, errgo.Notef(err, "cannot verify merged bundle")
+	}
+	if !opts.Highlight {
+		canvas, err := NewFromBundle(ctx, merged, iconURL, fetcher)
+		if err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Any)
+		}
+		return canvas, diffs, nil
+	}
+
+	// Work out the highlight of each application and relation, and
+	// draw a bundle that also holds everything that was removed, at
+	// its last position. As with NewFromBundleDiff, unit placements
+	// are dropped.
+	b := &charm.BundleData{
+		Type:         merged.Type,
+		Series:       merged.Series,
+		Applications: make(map[string]*charm.ApplicationSpec),
+		Saas:         make(map[string]*charm.SaasSpec),
+		Relations:    append([][]string(nil), merged.Relations...),
+	}
+	for name, app := range merged.Applications {
+		b.Applications[name] = withoutPlacement(app)
+	}
+	appHighlights := make(map[string]*highlight)
+	relHighlights := make(map[[2]string]*highlight)
+	removedRelations := make(map[[2]string][]string)
+	var highlights []*highlight
+	for i, diff := range diffs {
+		color := overlayColors[i%len(overlayColors)]
+		changedHighlight := &highlight{
+			label: overlayName(opts, i),
+			color: color,
+		}
+		removedHighlight := &highlight{
+			label: "Removed by " + overlayName(opts, i),
+			color: color,
+			faded: true,
+		}
+		highlights = append(highlights, changedHighlight, removedHighlight)
+		for name, appDiff := range diff.Applications {
+			if appDiff.Status != DiffRemoved {
+				appHighlights[name] = changedHighlight
+				continue
+			}
+			appHighlights[name] = removedHighlight
+			if _, ok := merged.Applications[name]; !ok {
+				b.Applications[name] = withoutPlacement(removed[i].Applications[name])
+			}
+		}
+		for _, rel := range diff.AddedRelations {
+			relHighlights[relationKey(rel)] = changedHighlight
+		}
+		for _, rel := range diff.RemovedRelations {
+			relHighlights[relationKey(rel)] = removedHighlight
+			removedRelations[relationKey(rel)] = rel
+		}
+	}
+	for _, bundle := range append(removed, merged) {
+		for name, saas := range bundle.Saas {
+			b.Saas[name] = saas
+		}
+	}
+	present := make(map[[2]string]bool)
+	for _, rel := range merged.Relations {
+		if len(rel) == 2 {
+			present[relationKey(rel)] = true
+		}
+	}
+	var extra [][]string
+	for key, rel := range removedRelations {
+		if !present[key] {
+			extra = append(extra, rel)
+		}
+	}
+	sortRelations(extra)
+	b.Relations = append(b.Relations, extra...)
+	canvas, err := NewFromBundle(ctx, b, iconURL, fetcher)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	used := make(map[*highlight]bool)
+	for _, application := range canvas.applications {
+		application.highlight = appHighlights[application.name]
+		used[application.highlight] = true
+	}
+	for _, relation := range canvas.relations {
+		relation.highlight = relHighlights[relationKey([]string{relation.endpointA, relation.endpointB})]
+		used[relation.highlight] = true
+	}
+	for _, h := range highlights {
+		if used[h] {
+			canvas.addHighlight(h)
+		}
+	}
+	return canvas, diffs, nil
+}
+
+// overlayName returns the name of the overlay with the given index.
+func overlayName(opts OverlayOptions, i int) string {
+	if len(opts.Names) > 0 {
+		return opts.Names[i]
+	}
+	return fmt.Sprintf("Overlay %d", i+1)
+}
+
+// overlayPart holds a bundle part along with the source it came from.
+type overlayPart struct {
+	src  charm.BundleDataSource
+	part *charm.BundleDataPart
+}
+
+// mergeParts returns the result of merging the given parts with
+// charm.ReadAndMergeBundleData. As that changes the bundle data it is
+// given, each part is copied first.
+func mergeParts(parts []*overlayPart) (*charm.BundleData, error) {
+	var sources []charm.BundleDataSource
+	var src *partsSource
+	for _, p := range parts {
+		if src == nil || src.BundleDataSource != p.src {
+			src = &partsSource{
+				BundleDataSource: p.src,
+			}
+			sources = append(sources, src)
+		}
+		src.parts = append(src.parts, &charm.BundleDataPart{
+			Data:        cloneBundleData(p.part.Data),
+			PresenceMap: p.part.PresenceMap,
+		})
+	}
+	b, err := charm.ReadAndMergeBundleData(sources...)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return b, nil
+}
+
+// partsSource is a charm.BundleDataSource that holds some of the parts
+// of another source.
+type partsSource struct {
+	charm.BundleDataSource
+	parts []*charm.BundleDataPart
+}
+
+// Parts implements charm.BundleDataSource.Parts.
+func (s *partsSource) Parts() []*charm.BundleDataPart {
+	return s.parts
+}
+
+// cloneBundleData returns a copy of b that shares no maps or slices
+// with it, so that either may be changed independently.
+func cloneBundleData(b *charm.BundleData) *charm.BundleData {
+	if b == nil {
+		return nil
+	}
+	b1 := *b
+	if b.Applications != nil {
+		b1.Applications = make(map[string]*charm.ApplicationSpec, len(b.Applications))
+		for name, app := range b.Applications {
+			b1.Applications[name] = cloneApplicationSpec(app)
+		}
+	}
+	if b.Machines != nil {
+		b1.Machines = make(map[string]*charm.MachineSpec, len(b.Machines))
+		for name, m := range b.Machines {
+			if m != nil {
+				m1 := *m
+				m1.Annotations = cloneStrings(m.Annotations)
+				m = &m1
+			}
+			b1.Machines[name] = m
+		}
+	}
+	if b.Saas != nil {
+		b1.Saas = make(map[string]*charm.SaasSpec, len(b.Saas))
+		for name, saas := range b.Saas {
+			if saas != nil {
+				saas1 := *saas
+				saas = &saas1
+			}
+			b1.Saas[name] = saas
+		}
+	}
+	if b.Relations != nil {
+		b1.Relations = make([][]string, len(b.Relations))
+		for i, rel := range b.Relations {
+			b1.Relations[i] = append([]string(nil), rel...)
+		}
+	}
+	b1.Tags = append([]string(nil), b.Tags...)
+	return &b1
+}
+
+// cloneApplicationSpec returns a copy of app that shares no maps or
+// slices with it.
+func cloneApplicationSpec(app *charm.ApplicationSpec) *charm.ApplicationSpec {
+	if app == nil {
+		return nil
+	}
+	app1 := *app
+	if app.To != nil {
+		app1.To = append([]string(nil), app.To...)
+	}
+	if app.Options != nil {
+		app1.Options = make(map[string]interface{}, len(app.Options))
+		for k, v := range app.Options {
+			app1.Options[k] = cloneValue(v)
+		}
+	}
+	app1.Annotations = cloneStrings(app.Annotations)
+	app1.Resources = cloneValue(app.Resources).(map[string]interface{})
+	app1.Storage = cloneStrings(app.Storage)
+	app1.Devices = cloneStrings(app.Devices)
+	app1.EndpointBindings = cloneStrings(app.EndpointBindings)
+	if app.Offers != nil {
+		app1.Offers = make(map[string]*charm.OfferSpec, len(app.Offers))
+		for name, offer := range app.Offers {
+			if offer != nil {
+				offer1 := *offer
+				offer1.Endpoints = append([]string(nil), offer.Endpoints...)
+				offer1.ACL = cloneStrings(offer.ACL)
+				offer = &offer1
+			}
+			app1.Offers[name] = offer
+		}
+	}
+	return &app1
+}
+
+// cloneStrings returns a copy of m.
+func cloneStrings(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	m1 := make(map[string]string, len(m))
+	for k, v := range m {
+		m1[k] = v
+	}
+	return m1
+}
+
+// cloneValue returns a copy of a value unmarshaled from YAML, copying
+// any maps and slices it holds.
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		v1 := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			v1[k] = cloneValue(x)
+		}
+		return v1
+	case map[interface{}]interface{}:
+		v1 := make(map[interface{}]interface{}, len(v))
+		for k, x := range v {
+			v1[k] = cloneValue(x)
+		}
+		return v1
+	case []interface{}:
+		v1 := make([]interface{}, len(v))
+		for i, x := range v {
+			v1[i] = cloneValue(x)
+		}
+		return v1
+	}
+	return v
+}
@@ -0,0 +1,294 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+const overlayBundle = `
+applications:
+  wordpress:
+    charm: cs:trusty/wordpress-5
+    num_units: 1
+  mysql:
+    charm: cs:trusty/mysql-1
+    num_units: 1
+  haproxy:
+    charm: cs:trusty/haproxy-2
+    num_units: 1
+relations:
+  - ["wordpress:db", "mysql:db"]
+--- # overlay
+applications:
+  mysql:
+    charm: cs:trusty/mysql-2
+  haproxy:
+  blog:
+    charm: cs:trusty/wordpress-5
+  local:
+    charm: ./charms/wordpress
+saas:
+  db:
+    url: admin/other.mysql
+  cache:
+    url: admin/other.memcached
+relations:
+  - ["blog:db", "db:db"]
+`
+
+func TestFetchIconsForSources(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	dir := c.Mkdir()
+	makeLocalCharms(c, dir)
+	src, err := charm.StreamBundleDataSource(strings.NewReader(overlayBundle), dir)
+	c.Assert(err, qt.IsNil)
+
+	remote := &pathFetcher{}
+	icons, err := FetchIconsForSources(ctx, &LocalFetcher{
+		Fetcher: remote,
+	}, map[string]string{
+		"db":    "cs:trusty/mysql-3",
+		"other": "cs:trusty/postgresql-1",
+	}, src)
+	c.Assert(err, qt.IsNil)
+	c.Assert(remote.fetched, qt.DeepEquals, map[string]int{
+		"trusty/wordpress-5": 1,
+		"trusty/mysql-1":     1,
+		"trusty/mysql-2":     1,
+		"trusty/mysql-3":     1,
+		"trusty/haproxy-2":   1,
+	})
+	c.Assert(icons, qt.HasLen, 7)
+	c.Assert(string(icons[SaasIconKey("db")]), qt.Equals, "<svg>trusty/mysql-3</svg>")
+	c.Assert(icons[SaasIconKey("cache")], qt.IsNil)
+
+	// The icons cover everything in the merged bundle.
+	src, err = charm.StreamBundleDataSource(strings.NewReader(overlayBundle), dir)
+	c.Assert(err, qt.IsNil)
+	b, err := charm.ReadAndMergeBundleData(src)
+	c.Assert(err, qt.IsNil)
+	for _, app := range b.Applications {
+		_, path, err := parseCharm(app.Charm)
+		c.Assert(err, qt.IsNil)
+		c.Assert(icons[path], qt.Not(qt.IsNil), qt.Commentf("%s", path))
+	}
+	// The SAAS entries are drawn along with the relation to one of
+	// them, using the icon fetched for it.
+	cvs, err := NewFromBundle(ctx, b, iconURL, icons)
+	c.Assert(err, qt.IsNil)
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), qt.Contains, "<title>db</title>")
+	c.Assert(buf.String(), qt.Contains, "<title>blog:db db:db</title>")
+	c.Assert(cvs.relations, qt.HasLen, 2)
+	saas := make(map[string]SceneApplication)
+	for _, app := range cvs.Scene().Applications {
+		if app.Saas {
+			saas[app.Name] = app
+		}
+	}
+	c.Assert(saas, qt.HasLen, 2)
+	c.Assert(saas["db"].Charm, qt.Equals, "saas:db")
+	c.Assert(saas["db"].IconID, qt.Not(qt.Equals), "")
+	c.Assert(saas["cache"].IconID, qt.Equals, "")
+	c.Assert(cvs.Positions(), qt.HasLen, 4)
+}
+
+const overlaysBase = `
+applications:
+  wordpress:
+    charm: cs:trusty/wordpress-5
+    num_units: 1
+    options:
+      blog-title: base
+    annotations:
+      gui-x: "100"
+      gui-y: "100"
+  mysql:
+    charm: cs:trusty/mysql-1
+    num_units: 1
+    annotations:
+      gui-x: "400"
+      gui-y: "100"
+  memcached:
+    charm: cs:trusty/memcached-1
+    num_units: 1
+    annotations:
+      gui-x: "100"
+      gui-y: "400"
+relations:
+  - ["wordpress:db", "mysql:db"]
+  - ["wordpress:cache", "memcached:cache"]
+`
+
+const overlaysStaging = `
+applications:
+  wordpress:
+    options:
+      blog-title: staging
+  haproxy:
+    charm: cs:trusty/haproxy-2
+    num_units: 1
+    annotations:
+      gui-x: "400"
+      gui-y: "400"
+relations:
+  - ["haproxy:reverseproxy", "wordpress:website"]
+--- # second overlay
+applications:
+  memcached:
+`
+
+func TestNewFromBundleOverlays(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	base, err := charm.StreamBundleDataSource(strings.NewReader(overlaysBase), "")
+	c.Assert(err, qt.IsNil)
+	staging, err := charm.StreamBundleDataSource(strings.NewReader(overlaysStaging), "")
+	c.Assert(err, qt.IsNil)
+	sources := []charm.BundleDataSource{base, staging}
+
+	cvs, diffs, err := NewFromBundleOverlays(ctx, sources, OverlayOptions{
+		Names:     []string{"staging", "no-cache"},
+		Highlight: true,
+	}, iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+	c.Assert(diffs, qt.DeepEquals, []*BundleDiff{{
+		Applications: map[string]*ApplicationDiff{
+			"haproxy": {
+				Status: DiffAdded,
+			},
+			"wordpress": {
+				Status: DiffChanged,
+				Options: map[string]Change{
+					"blog-title": {"base", "staging"},
+				},
+			},
+		},
+		AddedRelations: [][]string{{"haproxy:reverseproxy", "wordpress:website"}},
+	}, {
+		Applications: map[string]*ApplicationDiff{
+			"memcached": {
+				Status: DiffRemoved,
+			},
+		},
+		RemovedRelations: [][]string{{"wordpress:cache", "memcached:cache"}},
+	}})
+	// The sources are left unchanged.
+	c.Assert(base.Parts()[0].Data.Applications["wordpress"].Options["blog-title"], qt.Equals, "base")
+	c.Assert(base.Parts()[0].Data.Applications, qt.HasLen, 3)
+
+	labels := make(map[string]string)
+	for _, application := range cvs.applications {
+		labels[application.name] = highlightLabel(application.highlight)
+	}
+	c.Assert(labels, qt.DeepEquals, map[string]string{
+		"wordpress": "staging",
+		"haproxy":   "staging",
+		"memcached": "Removed by no-cache",
+		"mysql":     "",
+	})
+	labels = make(map[string]string)
+	for _, relation := range cvs.relations {
+		labels[relation.name] = highlightLabel(relation.highlight)
+	}
+	c.Assert(labels, qt.DeepEquals, map[string]string{
+		"wordpress:db mysql:db":                  "",
+		"haproxy:reverseproxy wordpress:website": "staging",
+		"wordpress:cache memcached:cache":        "Removed by no-cache",
+	})
+	var legend []string
+	for _, h := range cvs.legend {
+		legend = append(legend, highlightLabel(h))
+	}
+	c.Assert(legend, qt.DeepEquals, []string{"staging", "Removed by no-cache"})
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	out := buf.String()
+	c.Assert(out, qt.Contains, `stroke="#38b44a"`)
+	c.Assert(out, qt.Contains, `stroke="#19b6ee" stroke-dasharray="8, 4" opacity="0.5"`)
+
+	// Without highlighting, only the merged bundle is drawn.
+	cvs, diffs, err = NewFromBundleOverlays(ctx, sources, OverlayOptions{}, iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+	c.Assert(diffs, qt.HasLen, 2)
+	c.Assert(cvs.applications, qt.HasLen, 3)
+	c.Assert(cvs.legend, qt.HasLen, 0)
+	for _, application := range cvs.applications {
+		c.Assert(application.name, qt.Not(qt.Equals), "memcached")
+	}
+}
+
+const overlaysSaas = `
+saas:
+  db:
+    url: admin/other.mysql
+relations:
+  - ["wordpress:db", "db:db"]
+`
+
+func TestNewFromBundleOverlaysSaas(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	base, err := charm.StreamBundleDataSource(strings.NewReader(overlaysBase), "")
+	c.Assert(err, qt.IsNil)
+	saas, err := charm.StreamBundleDataSource(strings.NewReader(overlaysSaas), "")
+	c.Assert(err, qt.IsNil)
+	sources := []charm.BundleDataSource{base, saas}
+
+	for _, highlight := range []bool{false, true} {
+		c.Logf("highlight %v", highlight)
+		cvs, diffs, err := NewFromBundleOverlays(ctx, sources, OverlayOptions{
+			Highlight: highlight,
+		}, iconURL, new(emptyFetcher))
+		c.Assert(err, qt.IsNil)
+		c.Assert(diffs, qt.HasLen, 1)
+		c.Assert(diffs[0].AddedRelations, qt.DeepEquals, [][]string{{"wordpress:db", "db:db"}})
+		// The SAAS entry and the relation to it are drawn.
+		c.Assert(cvs.applications, qt.HasLen, 4)
+		c.Assert(cvs.relations, qt.HasLen, 3)
+		var buf bytes.Buffer
+		cvs.Marshal(&buf)
+		c.Assert(buf.String(), qt.Contains, "<title>wordpress:db db:db</title>")
+	}
+}
+
+func TestNewFromBundleOverlaysErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	base, err := charm.StreamBundleDataSource(strings.NewReader(overlaysBase), "")
+	c.Assert(err, qt.IsNil)
+	staging, err := charm.StreamBundleDataSource(strings.NewReader(overlaysStaging), "")
+	c.Assert(err, qt.IsNil)
+
+	_, _, err = NewFromBundleOverlays(ctx, []charm.BundleDataSource{base, staging}, OverlayOptions{
+		Names: []string{"staging"},
+	}, iconURL, nil)
+	c.Assert(err, qt.ErrorMatches, `got 1 names for 2 overlays`)
+
+	_, _, err = NewFromBundleOverlays(ctx, nil, OverlayOptions{}, iconURL, nil)
+	c.Assert(err, qt.ErrorMatches, `no bundle found`)
+
+	bad, err := charm.StreamBundleDataSource(strings.NewReader(`
+applications:
+  wordpress:
+    to: ["0"]
+relations:
+  - ["wordpress:db", "postgresql:db"]
+`), "")
+	c.Assert(err, qt.IsNil)
+	_, _, err = NewFromBundleOverlays(ctx, []charm.BundleDataSource{base, bad}, OverlayOptions{}, iconURL, nil)
+	c.Assert(err, qt.ErrorMatches, `cannot verify merged bundle: .*`)
+}
@@ -0,0 +1,105 @@
+package jujusvg
+
+import (
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"gopkg.in/errgo.v1"
+)
+
+// IconOverrides holds icons to draw in place of those fetched for
+// charms, for instance to apply custom branding.
+type IconOverrides struct {
+	// Charms holds icons keyed by charm name, such as "mysql", by
+	// charm path, such as "~charmers/trusty/mysql-38", or by a pattern
+	// matching charm paths as for path.Match, such as "*/mysql-*".
+	// An exact charm path takes precedence over a charm name, which
+	// takes precedence over patterns, of which the first matching one
+	// in sorted order is used.
+	Charms map[string]IconOverride
+
+	// Applications holds icons keyed by application name. They take
+	// precedence over those in Charms, and apply only to the named
+	// application, even if others use the same charm. SAAS entries,
+	// which have no charm, can be given icons only here.
+	Applications map[string]IconOverride
+}
+
+// IconOverride holds an icon, given either by its contents or by the
+// path of a file holding it.
+type IconOverride struct {
+	// Icon holds the contents of the icon.
+	Icon []byte
+
+	// File holds the path of the icon, which is read when Icon is
+	// empty.
+	File string
+}
+
+// OverrideIcons replaces the icons of the applications on the canvas with
+// those given, regardless of the icons that were fetched for them. As
+// for fetched icons, PNG, JPEG and GIF icons are embedded as data URIs.
+// Icons overridden for a single application are reported by
+// StrippedFromIcons and IconSizes under the application name with the
+// prefix "application:" rather than under its charm path.
+func (c *Canvas) OverrideIcons(o IconOverrides) error {
+	patterns := make([]string, 0, len(o.Charms))
+	for pattern := range o.Charms {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errgo.Notef(err, "invalid charm pattern %q", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, application := range c.applications {
+		override, ok := o.Applications[application.name]
+		if !ok && !application.saas {
+			override, ok = o.charmOverride(application.charmPath, patterns)
+		}
+		if !ok {
+			continue
+		}
+		icon, err := override.icon()
+		if err != nil {
+			return errgo.Notef(err, "cannot read icon for application %q", application.name)
+		}
+		if svg, err := svgIcon(icon, "", false, DefaultIconLimits.MaxPixels); err == nil {
+			icon = svg
+		}
+		application.iconSrc = icon
+		_, application.ownIcon = o.Applications[application.name]
+	}
+	return nil
+}
+
+// charmOverride returns the override for the charm with the given path,
+// using the given sorted patterns from o.Charms.
+func (o IconOverrides) charmOverride(charmPath string, patterns []string) (IconOverride, bool) {
+	if override, ok := o.Charms[charmPath]; ok {
+		return override, true
+	}
+	if charmId, _, err := parseCharm(charmPath); err == nil {
+		if override, ok := o.Charms[charmId.Name]; ok {
+			return override, true
+		}
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, charmPath); ok {
+			return o.Charms[pattern], true
+		}
+	}
+	return IconOverride{}, false
+}
+
+// icon returns the contents of the icon.
+func (o IconOverride) icon() ([]byte, error) {
+	if len(o.Icon) > 0 || o.File == "" {
+		return o.Icon, nil
+	}
+	icon, err := ioutil.ReadFile(o.File)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return icon, nil
+}
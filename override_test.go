@@ -0,0 +1,92 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+func TestOverrideIcons(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+
+	file := filepath.Join(c.Mkdir(), "elasticsearch.svg")
+	err := ioutil.WriteFile(file, []byte(`<svg xmlns="http://www.w3.org/2000/svg">from file</svg>`), 0644)
+	c.Assert(err, qt.IsNil)
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	b.Applications["mongodb2"] = &charm.ApplicationSpec{
+		Charm:    "cs:precise/mongodb-21",
+		NumUnits: 1,
+		Annotations: map[string]string{
+			"gui-x": "0",
+			"gui-y": "0",
+		},
+	}
+	cvs, err := NewFromBundle(ctx, b, iconURL, IconMap{
+		"precise/mongodb-21":                []byte(`<svg xmlns="http://www.w3.org/2000/svg">fetched</svg>`),
+		"~juju-jitsu/precise/charmworld-58": []byte(`<svg xmlns="http://www.w3.org/2000/svg">fetched</svg>`),
+	})
+	c.Assert(err, qt.IsNil)
+	err = cvs.OverrideIcons(IconOverrides{
+		Charms: map[string]IconOverride{
+			"charmworld":                        {Icon: []byte(`<svg xmlns="http://www.w3.org/2000/svg">by name</svg>`)},
+			"~juju-jitsu/precise/charmworld-58": {Icon: []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script/>by path</svg>`)},
+			"*/precise/elasticsearch-*":         {File: file},
+			"*":                                 {Icon: []byte(`<svg xmlns="http://www.w3.org/2000/svg">unused</svg>`)},
+		},
+		Applications: map[string]IconOverride{
+			"mongodb2": {Icon: rasterIcon(c, 10, 10)},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	out := buf.String()
+	c.Assert(out, qt.Contains, `<svg xmlns="http://www.w3.org/2000/svg" id="icon-1">by path</svg>`)
+	c.Assert(out, qt.Contains, `<svg xmlns="http://www.w3.org/2000/svg" id="icon-2">from file</svg>`)
+	c.Assert(out, qt.Contains, `<svg xmlns="http://www.w3.org/2000/svg" id="icon-3">fetched</svg>`)
+	c.Assert(out, qt.Matches, `(?s).*<svg xmlns="http://www.w3.org/2000/svg" width="96" height="96" viewBox="0 0 10 10" id="icon-4"><image .*`)
+	c.Assert(out, qt.Not(qt.Contains), "unused")
+	c.Assert(cvs.Scene().Applications[3].IconID, qt.Equals, "icon-4")
+
+	c.Assert(cvs.StrippedFromIcons(), qt.DeepEquals, map[string][]string{
+		"~juju-jitsu/precise/charmworld-58": {"element script"},
+	})
+	sizes := cvs.IconSizes()
+	c.Assert(sizes, qt.HasLen, 4)
+	c.Assert(sizes["application:mongodb2"].Embedded > 0, qt.Equals, true)
+}
+
+func TestOverrideIconsErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	cvs, err := NewFromBundle(ctx, b, iconURL, nil)
+	c.Assert(err, qt.IsNil)
+
+	err = cvs.OverrideIcons(IconOverrides{
+		Charms: map[string]IconOverride{
+			"[": {},
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid charm pattern "\[": syntax error in pattern`)
+
+	err = cvs.OverrideIcons(IconOverrides{
+		Applications: map[string]IconOverride{
+			"mongodb": {File: "/no/such/icon.svg"},
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot read icon for application "mongodb": open /no/such/icon.svg: no such file or directory`)
+}
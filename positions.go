@@ -0,0 +1,61 @@
+package jujusvg
+
+import (
+	"image"
+	"strconv"
+
+	"github.com/juju/charm/v7"
+	"gopkg.in/errgo.v1"
+)
+
+// Positions returns the final position of the top-left corner of each
+// application on the canvas, keyed by application name. This includes
+// the positions of any applications that were placed automatically.
+// Positions are given in the coordinate space of the gui-x and gui-y
+// annotations of the bundle from which the canvas was created, rather
+// than that of the generated SVG, so that they can be written back to
+// the bundle with SetBundlePositions. SAAS entries are not included, as
+// bundles do not record their positions.
+func (c *Canvas) Positions() map[string]image.Point {
+	positions := make(map[string]image.Point, len(c.applications))
+	for _, application := range c.applications {
+		if application.saas {
+			continue
+		}
+		positions[application.name] = application.point.Add(c.origin)
+	}
+	return positions
+}
+
+// SetBundlePositions sets the gui-x and gui-y annotations of the
+// applications in b to the given positions, as returned by
+// Canvas.Positions, so that the bundle is displayed with the same layout
+// elsewhere. Existing annotations that already hold the given position
+// are left unchanged. It is an error if a position is given for an
+// application that is not in the bundle, in which case the bundle is
+// left unchanged.
+func SetBundlePositions(b *charm.BundleData, positions map[string]image.Point) error {
+	for name := range positions {
+		if b.Applications[name] == nil {
+			return errgo.Newf("application %q not found in bundle", name)
+		}
+	}
+	for name, p := range positions {
+		applicationData := b.Applications[name]
+		if applicationData.Annotations == nil {
+			applicationData.Annotations = make(map[string]string)
+		}
+		setPositionAnnotation(applicationData.Annotations, "gui-x", p.X)
+		setPositionAnnotation(applicationData.Annotations, "gui-y", p.Y)
+	}
+	return nil
+}
+
+// setPositionAnnotation sets the given annotation to v, unless it
+// already holds a value that NewFromBundle would read as v.
+func setPositionAnnotation(annotations map[string]string, key string, v int) {
+	if old, err := strconv.ParseFloat(annotations[key], 64); err == nil && int(old) == v {
+		return
+	}
+	annotations[key] = strconv.Itoa(v)
+}
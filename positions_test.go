@@ -0,0 +1,106 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+func TestPositions(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	b.Applications["charmworld"].Annotations["gui-x"] = ""
+	b.Applications["charmworld"].Annotations["gui-y"] = ""
+
+	cvs, err := NewFromBundle(ctx, b, iconURL, nil)
+	c.Assert(err, qt.IsNil)
+	expected := map[string]image.Point{
+		"charmworld":    {1210, 478},
+		"elasticsearch": {490, 369},
+		"mongodb":       {940, 388},
+	}
+	c.Assert(cvs.Positions(), qt.DeepEquals, expected)
+
+	// Laying out the canvas does not change the reported positions.
+	var before bytes.Buffer
+	cvs.Marshal(&before)
+	c.Assert(cvs.Positions(), qt.DeepEquals, expected)
+
+	err = SetBundlePositions(b, cvs.Positions())
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.Applications["charmworld"].Annotations, qt.DeepEquals, map[string]string{
+		"gui-x": "1210",
+		"gui-y": "478",
+	})
+	// Existing positions are left alone.
+	c.Assert(b.Applications["mongodb"].Annotations, qt.DeepEquals, map[string]string{
+		"gui-x": "940.5",
+		"gui-y": "388.7698359714502",
+	})
+
+	// The updated bundle renders exactly as before.
+	cvs, err = NewFromBundle(ctx, b, iconURL, nil)
+	c.Assert(err, qt.IsNil)
+	var after bytes.Buffer
+	cvs.Marshal(&after)
+	c.Assert(after.String(), qt.Equals, before.String())
+}
+
+func TestSetBundlePositions(t *testing.T) {
+	c := qt.New(t)
+
+	b := &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"wordpress": {
+				Charm: "cs:wordpress",
+			},
+			"mysql": {
+				Charm: "cs:mysql",
+				Annotations: map[string]string{
+					"gui-x":  "10",
+					"gui-y":  "20",
+					"colour": "red",
+				},
+			},
+		},
+	}
+	err := SetBundlePositions(b, map[string]image.Point{
+		"wordpress": {-5, 7},
+		"mysql":     {10, 30},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.Applications["wordpress"].Annotations, qt.DeepEquals, map[string]string{
+		"gui-x": "-5",
+		"gui-y": "7",
+	})
+	c.Assert(b.Applications["mysql"].Annotations, qt.DeepEquals, map[string]string{
+		"gui-x":  "10",
+		"gui-y":  "30",
+		"colour": "red",
+	})
+
+	// Nothing is changed when an application is not found.
+	err = SetBundlePositions(b, map[string]image.Point{
+		"wordpress": {1, 2},
+		"mysql":     {3, 4},
+		"haproxy":   {0, 0},
+	})
+	c.Assert(err, qt.ErrorMatches, `application "haproxy" not found in bundle`)
+	c.Assert(b.Applications["wordpress"].Annotations, qt.DeepEquals, map[string]string{
+		"gui-x": "-5",
+		"gui-y": "7",
+	})
+	c.Assert(b.Applications["mysql"].Annotations, qt.DeepEquals, map[string]string{
+		"gui-x":  "10",
+		"gui-y":  "30",
+		"colour": "red",
+	})
+}
@@ -0,0 +1,112 @@
+package jujusvg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+
+	"gopkg.in/errgo.v1"
+)
+
+// rasterTypes holds the content types of the raster icons that can be
+// embedded.
+var rasterTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// svgIcon returns the given icon in a form that can be embedded in the
+// bundle diagram. SVG icons are returned unchanged. Raster icons, which
+// are recognised by their contents rather than by the given content
+// type, are returned as an SVG holding the image as a data URI. Raster
+// icons with more than maxPixels pixels are rejected before they are
+// decoded; if maxPixels is zero, the number of pixels is not limited.
+// If scale is true, raster icons larger than iconSize are scaled down
+// to fit.
+func svgIcon(icon []byte, contentType string, scale bool, maxPixels int64) ([]byte, error) {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "image/svg+xml" {
+		return icon, nil
+	}
+	contentType = http.DetectContentType(icon)
+	if !rasterTypes[contentType] {
+		return icon, nil
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(icon))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decode %s icon", contentType)
+	}
+	if maxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return nil, errgo.Newf("%s icon has more than %d pixels", contentType, maxPixels)
+	}
+	size := image.Point{cfg.Width, cfg.Height}
+	if scale && (size.X > iconSize || size.Y > iconSize) {
+		img, _, err := image.Decode(bytes.NewReader(icon))
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot decode %s icon", contentType)
+		}
+		img = scaleImage(img, iconSize)
+		size = img.Bounds().Size()
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, errgo.Notef(err, "cannot encode scaled %s icon", format)
+		}
+		icon, contentType = buf.Bytes(), "image/png"
+	}
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+
+		`<image width="%d" height="%d" href="data:%s;base64,%s"/>`+
+		`</svg>`,
+		iconSize, iconSize, size.X, size.Y,
+		size.X, size.Y, contentType, base64.StdEncoding.EncodeToString(icon))), nil
+}
+
+// scaleImage returns the given image scaled down to fit within a square
+// of the given size, keeping its aspect ratio. Each pixel of the result
+// is the average of the pixels of the original that it covers.
+func scaleImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = b.Dy() * size / b.Dx()
+	} else {
+		w = b.Dx() * size / b.Dy()
+	}
+	if w == 0 {
+		w = 1
+	}
+	if h == 0 {
+		h = 1
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			scaled.Set(x, y, color.NRGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return scaled
+}
@@ -0,0 +1,157 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"regexp"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+// rasterIcon returns a PNG icon of the given size.
+func rasterIcon(c *qt.C, w, h int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	c.Assert(err, qt.IsNil)
+	return buf.Bytes()
+}
+
+var dataURIRegexp = regexp.MustCompile(`href="data:([^;]+);base64,([^"]+)"`)
+
+// embeddedImage returns the content type and decoded configuration of
+// the image embedded in the given icon.
+func embeddedImage(c *qt.C, icon []byte) (string, image.Config) {
+	m := dataURIRegexp.FindSubmatch(icon)
+	c.Assert(m, qt.Not(qt.IsNil), qt.Commentf("%s", icon))
+	data, err := base64.StdEncoding.DecodeString(string(m[2]))
+	c.Assert(err, qt.IsNil)
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	c.Assert(err, qt.IsNil)
+	return string(m[1]), cfg
+}
+
+func TestSVGIcon(t *testing.T) {
+	c := qt.New(t)
+
+	// SVG icons are left alone.
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`)
+	icon, err := svgIcon(svg, "image/svg+xml; charset=utf-8", true, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icon, qt.DeepEquals, svg)
+	icon, err = svgIcon(svg, "", true, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(icon, qt.DeepEquals, svg)
+
+	// Raster icons are recognised regardless of the content type.
+	pngIcon := rasterIcon(c, 200, 100)
+	icon, err = svgIcon(pngIcon, "application/octet-stream", false, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(icon), qt.Matches, `<svg xmlns="http://www.w3.org/2000/svg" width="96" height="96" viewBox="0 0 200 100"><image width="200" height="100" href="data:image/png;base64,[^"]+"/></svg>`)
+	contentType, cfg := embeddedImage(c, icon)
+	c.Assert(contentType, qt.Equals, "image/png")
+	c.Assert(cfg.Width, qt.Equals, 200)
+	c.Assert(cfg.Height, qt.Equals, 100)
+
+	// Large icons can be scaled down, keeping their aspect ratio.
+	icon, err = svgIcon(pngIcon, "image/png", true, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(icon), qt.Matches, `<svg .* viewBox="0 0 96 48"><image width="96" height="48" .*`)
+	contentType, cfg = embeddedImage(c, icon)
+	c.Assert(contentType, qt.Equals, "image/png")
+	c.Assert(cfg.Width, qt.Equals, 96)
+	c.Assert(cfg.Height, qt.Equals, 48)
+
+	// Small icons are not scaled.
+	icon, err = svgIcon(rasterIcon(c, 32, 64), "image/png", true, 0)
+	c.Assert(err, qt.IsNil)
+	_, cfg = embeddedImage(c, icon)
+	c.Assert(cfg.Width, qt.Equals, 32)
+	c.Assert(cfg.Height, qt.Equals, 64)
+
+	// JPEG icons are embedded as JPEG unless they are scaled.
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 10)), nil)
+	c.Assert(err, qt.IsNil)
+	icon, err = svgIcon(buf.Bytes(), "", true, 0)
+	c.Assert(err, qt.IsNil)
+	contentType, _ = embeddedImage(c, icon)
+	c.Assert(contentType, qt.Equals, "image/jpeg")
+
+	// Corrupt raster icons cause an error. Only the header is
+	// decoded unless the icon is scaled.
+	_, err = svgIcon(pngIcon[:20], "", false, 0)
+	c.Assert(err, qt.ErrorMatches, `cannot decode image/png icon: .*`)
+	_, err = svgIcon(pngIcon[:100], "", false, 0)
+	c.Assert(err, qt.IsNil)
+	_, err = svgIcon(pngIcon[:100], "", true, 0)
+	c.Assert(err, qt.ErrorMatches, `cannot decode image/png icon: .*`)
+
+	// Raster icons with too many pixels are rejected without being
+	// decoded.
+	_, err = svgIcon(pngIcon, "", false, 200*100-1)
+	c.Assert(err, qt.ErrorMatches, `image/png icon has more than 19999 pixels`)
+	_, err = svgIcon(pngHeader(100000, 100000), "", true, DefaultIconLimits.MaxPixels)
+	c.Assert(err, qt.ErrorMatches, `image/png icon has more than 16777216 pixels`)
+}
+
+// pngHeader returns the start of a PNG image with the given
+// dimensions, holding no pixel data.
+func pngHeader(w, h uint32) []byte {
+	chunk := make([]byte, 17)
+	copy(chunk, "IHDR")
+	binary.BigEndian.PutUint32(chunk[4:], w)
+	binary.BigEndian.PutUint32(chunk[8:], h)
+	chunk[12] = 8 // bit depth
+	chunk[13] = 6 // RGBA
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(13))
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestScaleImage(t *testing.T) {
+	c := qt.New(t)
+
+	img := image.NewGray(image.Rect(0, 0, 4, 2))
+	img.Pix = []uint8{
+		0, 100, 10, 20,
+		200, 100, 30, 40,
+	}
+	scaled := scaleImage(img, 2)
+	c.Assert(scaled.Bounds(), qt.Equals, image.Rect(0, 0, 2, 1))
+	c.Assert(color.GrayModel.Convert(scaled.At(0, 0)), qt.Equals, color.Gray{100})
+	c.Assert(color.GrayModel.Convert(scaled.At(1, 0)), qt.Equals, color.Gray{25})
+}
+
+func TestNewFromBundleRasterIcon(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	cvs, err := NewFromBundle(ctx, b, iconURL, IconMap{
+		"precise/mongodb-21": rasterIcon(c, 20, 20),
+	})
+	c.Assert(err, qt.IsNil)
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), qt.Matches, `(?s).*<svg xmlns="http://www.w3.org/2000/svg" width="96" height="96" viewBox="0 0 20 20" id="icon-\d+"><image width="20" height="20" href="data:image/png;base64,[^"]+"></image></svg>.*`)
+}
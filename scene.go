@@ -0,0 +1,180 @@
+package jujusvg
+
+import (
+	"encoding/json"
+	"image"
+	"io"
+
+	"gopkg.in/errgo.v1"
+)
+
+// SceneVersion is the version of the schema used by Scene. It is
+// incremented whenever a change is made to the schema that is not
+// backwardly compatible.
+const SceneVersion = 1
+
+// Scene holds the computed layout of a Canvas in a form suitable for
+// rendering by other means. All coordinates are in the same units as the
+// generated SVG, with the origin at the top-left corner of the canvas.
+//
+// When encoded as JSON, a scene has the following form:
+//
+//	{
+//		"version": 1,
+//		"width": 631,
+//		"height": 457,
+//		"applications": [{
+//			"name": "mongodb",
+//			"charm": "precise/mongodb-21",
+//			"x": 450,
+//			"y": 276,
+//			"width": 180,
+//			"height": 180,
+//			"icon-url": "https://example.com/precise/mongodb-21/icon.svg",
+//			"icon-id": "icon-3"
+//		}],
+//		"relations": [{
+//			"name": "charmworld:database mongodb:database",
+//			"endpoints": ["charmworld:database", "mongodb:database"],
+//			"applications": ["charmworld", "mongodb"],
+//			"line": [{"x": 413, "y": 90}, {"x": 540, "y": 366}],
+//			"connectors": [{"x": 450, "y": 171}, {"x": 502, "y": 284}],
+//			"health": {"x": 468, "y": 220}
+//		}]
+//	}
+type Scene struct {
+	// Version holds the schema version, currently SceneVersion.
+	Version int `json:"version"`
+
+	// Width and Height hold the overall size of the canvas.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// Applications holds an entry for each application and SAAS
+	// entry, in the order in which they are drawn.
+	Applications []SceneApplication `json:"applications"`
+
+	// Relations holds an entry for each relation, in the order in
+	// which they are drawn.
+	Relations []SceneRelation `json:"relations"`
+}
+
+// SceneApplication holds the placement of a single application.
+type SceneApplication struct {
+	// Name holds the name of the application.
+	Name string `json:"name"`
+
+	// Charm holds the path of the application's charm URL, which
+	// is also the key used for its icon by IconFetcher. For a SAAS
+	// entry, it holds the key returned by SaasIconKey.
+	Charm string `json:"charm"`
+
+	// Saas holds whether the entry is a SAAS entry rather than an
+	// application.
+	Saas bool `json:"saas,omitempty"`
+
+	// X and Y hold the top-left corner of the application block.
+	X int `json:"x"`
+	Y int `json:"y"`
+
+	// Width and Height hold the size of the application block.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// IconURL holds the URL of the charm's icon, if known.
+	IconURL string `json:"icon-url,omitempty"`
+
+	// IconID holds the id of the icon definition within the
+	// generated SVG, if the icon contents were fetched.
+	IconID string `json:"icon-id,omitempty"`
+}
+
+// SceneRelation holds the geometry of a single relation.
+type SceneRelation struct {
+	// Name holds the name of the relation, as shown in the SVG.
+	Name string `json:"name"`
+
+	// Endpoints holds the two endpoints of the relation as
+	// specified in the bundle.
+	Endpoints [2]string `json:"endpoints"`
+
+	// Applications holds the names of the two related applications.
+	Applications [2]string `json:"applications"`
+
+	// Line holds the start and end points of the relation line,
+	// which join the centres of the two application blocks.
+	Line [2]ScenePoint `json:"line"`
+
+	// Connectors holds the points at which the relation line
+	// meets the edge of each application block.
+	Connectors [2]ScenePoint `json:"connectors"`
+
+	// Health holds the top-left corner of the relation health
+	// indicator.
+	Health ScenePoint `json:"health"`
+}
+
+// ScenePoint holds a point within a scene.
+type ScenePoint struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Scene lays out the canvas and returns the resulting placement of
+// all applications and relations.
+func (c *Canvas) Scene() *Scene {
+	width, height := c.layout()
+	scene := &Scene{
+		Version:      SceneVersion,
+		Width:        width,
+		Height:       height,
+		Applications: make([]SceneApplication, 0, len(c.applications)),
+		Relations:    make([]SceneRelation, 0, len(c.relations)),
+	}
+	// Icon ids are allocated in the same way as by Marshal so that
+	// they match up with the generated SVG.
+	iconsRendered := make(map[string]bool)
+	iconIds := make(map[string]string)
+	for _, application := range c.applications {
+		application.embedIcon(iconsRendered, iconIds, c.iconOptions())
+		scene.Applications = append(scene.Applications, SceneApplication{
+			Name:    application.name,
+			Charm:   application.charmPath,
+			Saas:    application.saas,
+			X:       application.point.X,
+			Y:       application.point.Y,
+			Width:   applicationBlockSize,
+			Height:  applicationBlockSize,
+			IconURL: application.iconUrl,
+			IconID:  iconIds[application.iconKey()],
+		})
+	}
+	for _, relation := range c.relations {
+		g := relation.geometry()
+		scene.Relations = append(scene.Relations, SceneRelation{
+			Name:         relation.name,
+			Endpoints:    [2]string{relation.endpointA, relation.endpointB},
+			Applications: [2]string{relation.applicationA.name, relation.applicationB.name},
+			Line:         [2]ScenePoint{scenePoint(g.line.p0), scenePoint(g.line.p1)},
+			Connectors:   [2]ScenePoint{scenePoint(g.connectorA), scenePoint(g.connectorB)},
+			Health:       scenePoint(g.health),
+		})
+	}
+	return scene
+}
+
+// MarshalScene writes the scene for the canvas to the given io.Writer
+// as JSON.
+func (c *Canvas) MarshalScene(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(c.Scene()); err != nil {
+		return errgo.Notef(err, "cannot encode scene")
+	}
+	return nil
+}
+
+// scenePoint converts an image.Point to a ScenePoint.
+func scenePoint(p image.Point) ScenePoint {
+	return ScenePoint{X: p.X, Y: p.Y}
+}
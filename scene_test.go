@@ -0,0 +1,148 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+func TestScene(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	err = b.Verify(nil, nil, nil)
+	c.Assert(err, qt.IsNil)
+
+	cvs, err := NewFromBundle(ctx, b, iconURL, nil)
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(cvs.Scene(), qt.DeepEquals, &Scene{
+		Version: SceneVersion,
+		Width:   631,
+		Height:  457,
+		Applications: []SceneApplication{{
+			Name:    "charmworld",
+			Charm:   "~juju-jitsu/precise/charmworld-58",
+			X:       323,
+			Y:       0,
+			Width:   180,
+			Height:  180,
+			IconURL: "http://0.1.2.3/~juju-jitsu/precise/charmworld-58.svg",
+			IconID:  "icon-1",
+		}, {
+			Name:    "elasticsearch",
+			Charm:   "~charming-devs/precise/elasticsearch-2",
+			X:       0,
+			Y:       257,
+			Width:   180,
+			Height:  180,
+			IconURL: "http://0.1.2.3/~charming-devs/precise/elasticsearch-2.svg",
+			IconID:  "icon-2",
+		}, {
+			Name:    "mongodb",
+			Charm:   "precise/mongodb-21",
+			X:       450,
+			Y:       276,
+			Width:   180,
+			Height:  180,
+			IconURL: "http://0.1.2.3/precise/mongodb-21.svg",
+			IconID:  "icon-3",
+		}},
+		Relations: []SceneRelation{{
+			Name:         "charmworld:essearch elasticsearch:essearch",
+			Endpoints:    [2]string{"charmworld:essearch", "elasticsearch:essearch"},
+			Applications: [2]string{"charmworld", "elasticsearch"},
+			Line:         [2]ScenePoint{{413, 90}, {90, 347}},
+			Connectors:   [2]ScenePoint{{342, 146}, {160, 290}},
+			Health:       ScenePoint{243, 210},
+		}, {
+			Name:         "charmworld:database mongodb:database",
+			Endpoints:    [2]string{"charmworld:database", "mongodb:database"},
+			Applications: [2]string{"charmworld", "mongodb"},
+			Line:         [2]ScenePoint{{413, 90}, {540, 366}},
+			Connectors:   [2]ScenePoint{{450, 171}, {502, 284}},
+			Health:       ScenePoint{468, 220},
+		}},
+	})
+}
+
+func TestMarshalScene(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	err = b.Verify(nil, nil, nil)
+	c.Assert(err, qt.IsNil)
+
+	cvs, err := NewFromBundle(ctx, b, iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+
+	var buf bytes.Buffer
+	err = cvs.MarshalScene(&buf)
+	c.Assert(err, qt.IsNil)
+	c.Logf("%s", buf.String())
+
+	var obtained map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &obtained)
+	c.Assert(err, qt.IsNil)
+	c.Assert(obtained["version"], qt.Equals, float64(SceneVersion))
+	c.Assert(obtained["width"], qt.Equals, float64(631))
+	c.Assert(obtained["height"], qt.Equals, float64(457))
+	apps := obtained["applications"].([]interface{})
+	c.Assert(apps, qt.HasLen, 3)
+	// Icons are not embedded, so no icon id is reported.
+	c.Assert(apps[0], qt.DeepEquals, map[string]interface{}{
+		"name":     "charmworld",
+		"charm":    "~juju-jitsu/precise/charmworld-58",
+		"x":        float64(323),
+		"y":        float64(0),
+		"width":    float64(180),
+		"height":   float64(180),
+		"icon-url": "http://0.1.2.3/~juju-jitsu/precise/charmworld-58.svg",
+	})
+	rels := obtained["relations"].([]interface{})
+	c.Assert(rels, qt.HasLen, 2)
+	c.Assert(rels[1].(map[string]interface{})["line"], qt.DeepEquals, []interface{}{
+		map[string]interface{}{"x": float64(413), "y": float64(90)},
+		map[string]interface{}{"x": float64(540), "y": float64(366)},
+	})
+}
+
+func TestSceneInvalidIcon(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, qt.IsNil)
+	cvs, err := NewFromBundle(ctx, b, iconURL, IconMap{
+		"~juju-jitsu/precise/charmworld-58":      []byte("bad-wolf"),
+		"~charming-devs/precise/elasticsearch-2": []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`),
+		"precise/mongodb-21":                     []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`),
+	})
+	c.Assert(err, qt.IsNil)
+
+	// The icon that cannot be embedded is given no id, and the ids
+	// of the others match those in the SVG.
+	ids := make(map[string]string)
+	for _, application := range cvs.Scene().Applications {
+		ids[application.Name] = application.IconID
+	}
+	c.Assert(ids, qt.DeepEquals, map[string]string{
+		"charmworld":    "",
+		"elasticsearch": "icon-2",
+		"mongodb":       "icon-3",
+	})
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), qt.Not(qt.Contains), `"icon-1"`)
+	c.Assert(buf.String(), qt.Contains, `id="icon-2"`)
+	c.Assert(buf.String(), qt.Contains, `xlink:href="#icon-3"`)
+}
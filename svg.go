@@ -1,7 +1,13 @@
 package jujusvg
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/juju/xml"
 	"gopkg.in/errgo.v1"
@@ -15,12 +21,41 @@ const svgNamespace = "http://www.w3.org/2000/svg"
 // addition, loosely check that the icon is a valid SVG file.  The id
 // argument provides a unique identifier for the icon SVG so that it can
 // be referenced within the bundle diagram.  If an id attribute on the SVG
-// tag already exists, it will be replaced with this argument.
-func processIcon(r io.Reader, w io.Writer, id string) error {
+// tag already exists, it will be replaced with this argument.  Other ids
+// within the icon are prefixed with the id argument, and references to
+// them, including id selectors in style sheets, are changed to match, so
+// that they cannot clash with those in other icons.  Style sheet rules
+// are restricted to the icon for the same reason.
+//
+// Icons may come from untrusted sources, so only the elements and
+// attributes in svgElements and svgAttrs are kept, and references to
+// anything outside the icon are removed, other than to opts.trustedURL.
+// Descriptions of what was removed are returned in sorted order.
+//
+// An error is returned if the icon exceeds opts.limits.  If opts.minify
+// is set, the icon is also made smaller where that does not change how
+// it is drawn.
+func processIcon(r io.Reader, w io.Writer, id string, opts iconOptions) ([]string, error) {
+	if max := opts.limits.MaxBytes; max > 0 {
+		data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read icon")
+		}
+		if int64(len(data)) > max {
+			return nil, errgo.Newf("icon is larger than %d bytes", max)
+		}
+		r = bytes.NewReader(data)
+	}
 	dec := xml.NewDecoder(r)
 	dec.DefaultSpace = svgNamespace
 
 	enc := xml.NewEncoder(w)
+	s := iconSanitizer{
+		trustedURL: opts.trustedURL,
+	}
+	ids := iconIDs{
+		id: id,
+	}
 
 	svgStartFound := false
 	svgEndFound := false
@@ -31,57 +66,574 @@ func processIcon(r io.Reader, w io.Writer, id string) error {
 			if err == io.EOF {
 				break
 			}
-			return errgo.Notef(err, "cannot get token")
+			return nil, errgo.Notef(err, "cannot get token")
 		}
 		tag, ok := tok.(xml.StartElement)
 		if ok && tag.Name.Space == svgNamespace && tag.Name.Local == "svg" {
 			svgStartFound = true
 			depth++
-			tag.Attr = setXMLAttr(tag.Attr, xml.Name{
+			if err := opts.limits.check(tag, 1, 1); err != nil {
+				return nil, errgo.Mask(err)
+			}
+			ids.rootID = getXMLAttr(tag.Attr, xml.Name{
+				Local: "id",
+			})
+			tag.Attr = setXMLAttr(ids.attrs(s.attrs(tag)), xml.Name{
 				Local: "id",
 			}, id)
+			if opts.minify != nil {
+				tag.Attr = opts.minify.attrs(tag.Attr)
+			}
 			if err := enc.EncodeToken(tag); err != nil {
-				return errgo.Notef(err, "cannot encode token %#v", tag)
+				return nil, errgo.Notef(err, "cannot encode token %#v", tag)
 			}
 		}
 	}
+	// parents holds the names of the elements enclosing the current
+	// token, and skip holds the depth within an element that is being
+	// removed.
+	parents := []string{"svg"}
+	skip := 0
+	// style holds the text of the current <style> element, which is
+	// checked as a whole when the element ends.
+	var style []byte
+	// elements and nesting hold the number of elements in the icon
+	// and the depth of the current one, including those removed.
+	elements, nesting := 1, 1
 	for depth > 0 {
 		tok, err := dec.Token()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return errgo.Notef(err, "cannot get token")
+			return nil, errgo.Notef(err, "cannot get token")
 		}
 		switch tag := tok.(type) {
 		case xml.StartElement:
+			elements++
+			nesting++
+			if err := opts.limits.check(tag, elements, nesting); err != nil {
+				return nil, errgo.Mask(err)
+			}
 			if tag.Name.Space == svgNamespace && tag.Name.Local == "svg" {
 				depth++
 			}
+			if skip > 0 || !s.allowElement(tag.Name, parents[len(parents)-1]) {
+				skip++
+				continue
+			}
+			tag.Attr = ids.attrs(s.attrs(tag))
+			if opts.minify != nil {
+				tag.Attr = opts.minify.attrs(tag.Attr)
+			}
+			tok = tag
+			parents = append(parents, tag.Name.Local)
 		case xml.EndElement:
+			nesting--
 			if tag.Name.Space == svgNamespace && tag.Name.Local == "svg" {
 				depth--
 				if depth == 0 {
 					svgEndFound = true
 				}
 			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if parents[len(parents)-1] == "style" {
+				text := xml.CharData(s.styleText(string(style), &ids))
+				if opts.minify != nil {
+					text = opts.minify.text("style", text)
+				}
+				if len(text) > 0 {
+					if err := enc.EncodeToken(text); err != nil {
+						return nil, errgo.Notef(err, "cannot encode token %#v", text)
+					}
+				}
+				style = nil
+			}
+			parents = parents[:len(parents)-1]
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+			if parents[len(parents)-1] == "style" {
+				style = append(style, tag...)
+				continue
+			}
+			if opts.minify != nil {
+				tag = opts.minify.text(parents[len(parents)-1], tag)
+			}
+			if len(tag) == 0 {
+				continue
+			}
+			tok = tag
+		case xml.Comment:
+			// Comments within a <style> element are dropped so
+			// that the text either side of them is joined, as
+			// it is when the style sheet is used.
+			if skip > 0 || opts.minify != nil || parents[len(parents)-1] == "style" {
+				continue
+			}
+		case xml.ProcInst:
+			s.strip("processing instruction " + tag.Target)
+			continue
+		case xml.Directive:
+			s.strip("directive")
+			continue
 		}
 		if err := enc.EncodeToken(tok); err != nil {
-			return errgo.Notef(err, "cannot encode token %#v", tok)
+			return nil, errgo.Notef(err, "cannot encode token %#v", tok)
 		}
 	}
 
 	if !svgStartFound || !svgEndFound {
-		return errgo.Newf("icon does not appear to be a valid SVG")
+		return nil, errgo.Newf("icon does not appear to be a valid SVG")
 	}
 
 	if err := enc.Flush(); err != nil {
-		return err
+		return nil, err
 	}
 
+	return s.stripped(), nil
+}
+
+// check returns an error if the given element, which is the given number
+// of elements into the icon and nested to the given depth, exceeds the
+// limits.
+func (l IconLimits) check(tag xml.StartElement, elements, depth int) error {
+	if l.MaxElements > 0 && elements > l.MaxElements {
+		return errgo.Newf("icon has more than %d elements", l.MaxElements)
+	}
+	if l.MaxDepth > 0 && depth > l.MaxDepth {
+		return errgo.Newf("icon has elements nested more than %d deep", l.MaxDepth)
+	}
+	if l.MaxDataURIBytes > 0 {
+		for _, attr := range tag.Attr {
+			if len(attr.Value) > l.MaxDataURIBytes && strings.HasPrefix(strings.TrimSpace(strings.ToLower(attr.Value)), "data:") {
+				return errgo.Newf("icon has a data URI larger than %d bytes", l.MaxDataURIBytes)
+			}
+		}
+	}
 	return nil
 }
 
+// iconIDs rewrites the ids within an icon, and references to them, so
+// that they are unique within the bundle diagram.
+type iconIDs struct {
+	// id holds the id given to the icon, which is also used as the
+	// prefix for the ids within it.
+	id string
+
+	// rootID holds the original id of the icon's svg element, if any.
+	rootID string
+}
+
+// urlRefRegexp matches references of the form url(#id) in attribute
+// values and style sheets.
+var urlRefRegexp = regexp.MustCompile(`(url\(\s*['"]?#)([^)'"\s]+)`)
+
+// attrs returns the given attributes with ids and references rewritten.
+func (ids *iconIDs) attrs(attrs []xml.Attr) []xml.Attr {
+	for i, attr := range attrs {
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "id":
+			attrs[i].Value = ids.id + "-" + attr.Value
+		case attr.Name.Local == "href" && strings.HasPrefix(strings.TrimSpace(attr.Value), "#"):
+			// Surrounding white space is ignored, as by
+			// internalHref.
+			attrs[i].Value = "#" + ids.ref(strings.TrimSpace(attr.Value)[1:])
+		default:
+			attrs[i].Value = ids.urls(attr.Value)
+		}
+	}
+	return attrs
+}
+
+// urls returns the given attribute value or style sheet with any
+// references of the form url(#id) rewritten.
+func (ids *iconIDs) urls(s string) string {
+	if !strings.Contains(s, "#") {
+		return s
+	}
+	return urlRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		m := urlRefRegexp.FindStringSubmatch(ref)
+		return m[1] + ids.ref(m[2])
+	})
+}
+
+// styleSheet returns the given style sheet, which holds no comments or
+// at-rules, with each selector restricted to elements within the icon.
+func (ids *iconIDs) styleSheet(css string) string {
+	var buf strings.Builder
+	for {
+		open := cssIndex(css, '{', 0)
+		if open < 0 {
+			return buf.String()
+		}
+		// Find the end of the block, allowing for any blocks
+		// nested within it, as they are when it is parsed.
+		end, depth := open, 0
+		for end < len(css) {
+			i := cssIndex(css[end:], '{', '}')
+			if i < 0 {
+				end = len(css)
+				break
+			}
+			end += i + 1
+			if css[end-1] == '{' {
+				depth++
+			} else if depth--; depth == 0 {
+				break
+			}
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		selectors := strings.Split(css[:open], ",")
+		for i, sel := range selectors {
+			selectors[i] = ids.selector(strings.TrimSpace(sel))
+		}
+		buf.WriteString(strings.Join(selectors, ", "))
+		buf.WriteString(" ")
+		buf.WriteString(ids.urls(css[open:end]))
+		css = css[end:]
+	}
+}
+
+// idSelectorRegexp matches an id selector.
+var idSelectorRegexp = regexp.MustCompile(`#(-?[_a-zA-Z][-_a-zA-Z0-9]*)`)
+
+// selector returns the given CSS selector with its id selectors
+// rewritten, restricted to elements within the icon. Selectors that
+// start with the id of the icon's svg element already are.
+func (ids *iconIDs) selector(sel string) string {
+	sel = idSelectorRegexp.ReplaceAllStringFunc(sel, func(ref string) string {
+		return "#" + ids.ref(ref[1:])
+	})
+	root := "#" + ids.id
+	if rest := strings.TrimPrefix(sel, root); rest != sel && (rest == "" || !isCSSNameChar(rest[0])) {
+		return sel
+	}
+	return "#" + ids.id + " " + sel
+}
+
+// isCSSNameChar reports whether the given character may be part of a
+// CSS name.
+func isCSSNameChar(c byte) bool {
+	return c == '-' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// cssIndex returns the index of the first instance of either of the
+// given characters in css that is not within a string, or -1 if there
+// is none. A zero character matches nothing.
+func cssIndex(css string, c1, c2 byte) int {
+	var quote byte
+	for i := 0; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case quote != 0:
+			if c == quote || c == '\n' {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c != 0 && (c == c1 || c == c2):
+			return i
+		}
+	}
+	return -1
+}
+
+// ref returns the new id for the element with the given original id.
+func (ids *iconIDs) ref(id string) string {
+	if ids.rootID != "" && id == ids.rootID {
+		return ids.id
+	}
+	return ids.id + "-" + id
+}
+
+// svgElements holds the SVG elements that are allowed in icons.  Scripts,
+// animations (which can change references) and elements that embed other
+// documents are not included.
+var svgElements = stringSet(
+	"circle", "clipPath", "defs", "desc", "ellipse", "feBlend",
+	"feColorMatrix", "feComponentTransfer", "feComposite",
+	"feConvolveMatrix", "feDiffuseLighting", "feDisplacementMap",
+	"feDistantLight", "feDropShadow", "feFlood", "feFuncA", "feFuncB",
+	"feFuncG", "feFuncR", "feGaussianBlur", "feImage", "feMerge",
+	"feMergeNode", "feMorphology", "feOffset", "fePointLight",
+	"feSpecularLighting", "feSpotLight", "feTile", "feTurbulence",
+	"filter", "g", "image", "line", "linearGradient", "marker", "mask",
+	"path", "pattern", "polygon", "polyline", "radialGradient", "rect",
+	"stop", "style", "svg", "switch", "symbol", "text", "textPath",
+	"title", "tspan", "use",
+)
+
+// svgAttrs holds the unqualified attributes that are allowed in icons.
+// Event handler attributes are not included.
+var svgAttrs = stringSet(
+	"alignment-baseline", "amplitude", "baseFrequency", "baseline-shift",
+	"class", "clip", "clip-path", "clip-rule", "clipPathUnits", "color",
+	"color-interpolation", "color-interpolation-filters",
+	"color-rendering", "cx", "cy", "d", "diffuseConstant", "direction",
+	"display", "divisor", "dominant-baseline", "dx", "dy", "edgeMode",
+	"elevation", "enable-background", "exponent", "fill",
+	"fill-opacity", "fill-rule", "filter", "filterUnits",
+	"flood-color", "flood-opacity", "font-family", "font-size",
+	"font-size-adjust", "font-stretch", "font-style", "font-variant",
+	"font-weight", "fr", "fx", "fy", "gradientTransform",
+	"gradientUnits", "height", "href", "id", "image-rendering", "in",
+	"in2", "intercept", "isolation", "k", "k1", "k2", "k3", "k4",
+	"kernelMatrix", "kernelUnitLength", "lengthAdjust",
+	"letter-spacing", "lighting-color", "limitingConeAngle",
+	"marker-end", "marker-mid", "marker-start", "markerHeight",
+	"markerUnits", "markerWidth", "mask", "maskContentUnits",
+	"maskUnits", "mix-blend-mode", "mode", "numOctaves", "offset",
+	"opacity", "operator", "order", "orient", "overflow",
+	"paint-order", "pathLength", "patternContentUnits",
+	"patternTransform", "patternUnits", "points", "pointsAtX",
+	"pointsAtY", "pointsAtZ", "preserveAlpha", "preserveAspectRatio",
+	"primitiveUnits", "r", "radius", "refX", "refY", "result",
+	"rotate", "rx", "ry", "scale", "seed", "shape-rendering", "slope",
+	"spacing", "specularConstant", "specularExponent", "spreadMethod",
+	"startOffset", "stdDeviation", "stitchTiles", "stop-color",
+	"stop-opacity", "stroke", "stroke-dasharray", "stroke-dashoffset",
+	"stroke-linecap", "stroke-linejoin", "stroke-miterlimit",
+	"stroke-opacity", "stroke-width", "style", "surfaceScale",
+	"tableValues", "targetX", "targetY", "text-anchor",
+	"text-decoration", "text-rendering", "textLength", "transform",
+	"type", "values", "vector-effect", "version", "viewBox",
+	"visibility", "width", "word-spacing", "writing-mode", "x",
+	"x1", "x2", "xChannelSelector", "y", "y1", "y2",
+	"yChannelSelector", "z",
+)
+
+const (
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+	xmlNamespace   = "http://www.w3.org/XML/1998/namespace"
+)
+
+// iconOptions holds options for processIcon.
+type iconOptions struct {
+	// trustedURL holds a URL that the icon may refer to, typically
+	// the icon URL of the charm, which is used by LinkFetcher.
+	trustedURL string
+
+	// limits holds the limits on the size and complexity of the
+	// icon.
+	limits IconLimits
+
+	// minify holds how to minify the icon, or nil if it should not
+	// be minified.
+	minify *iconMinifier
+}
+
+// iconSanitizer removes content that is not allowed from icons, keeping
+// a record of what was removed.
+type iconSanitizer struct {
+	trustedURL string
+	removed    map[string]bool
+}
+
+// allowElement reports whether the element with the given name may be
+// included in an icon within the given parent element. Nothing is
+// allowed within a <style> element other than its text.
+func (s *iconSanitizer) allowElement(name xml.Name, parent string) bool {
+	if name.Space == svgNamespace && svgElements[name.Local] && parent != "style" {
+		return true
+	}
+	s.strip("element " + xmlName(name))
+	return false
+}
+
+// attrs returns the attributes of the given element that may be
+// included in an icon.
+func (s *iconSanitizer) attrs(tag xml.StartElement) []xml.Attr {
+	attrs := make([]xml.Attr, 0, len(tag.Attr))
+	for _, attr := range tag.Attr {
+		switch {
+		case attr.Name.Space == "xmlns" || attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			// Namespace declarations are needed to encode the
+			// names that remain.
+		case attr.Name.Local == "href" && (attr.Name.Space == "" || attr.Name.Space == xlinkNamespace):
+			if !internalHref(tag.Name, attr.Value) && (s.trustedURL == "" || attr.Value != s.trustedURL) {
+				s.strip("reference " + quoteValue(attr.Value))
+				continue
+			}
+		case attr.Name.Space == xmlNamespace || attr.Name.Space == "xml":
+			if attr.Name.Local != "space" && attr.Name.Local != "lang" {
+				s.strip("attribute " + xmlName(attr.Name))
+				continue
+			}
+		case attr.Name.Space != "" || !svgAttrs[attr.Name.Local]:
+			s.strip("attribute " + xmlName(attr.Name))
+			continue
+		default:
+			// Attribute values may be parsed as CSS, so comments
+			// are removed and escapes, which could hide a
+			// reference, are not allowed.
+			if strings.Contains(attr.Value, "/*") {
+				attr.Value = removeCSSComments(attr.Value)
+			}
+			if strings.Contains(attr.Value, `\`) {
+				s.strip("attribute " + xmlName(attr.Name) + " with CSS escapes")
+				continue
+			}
+			if ref := externalReference(attr.Value); ref != "" {
+				s.strip("reference " + quoteValue(ref))
+				continue
+			}
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+// styleText returns the given contents of a <style> element with its
+// comments removed and its rules scoped to the icon, or nothing if they
+// refer to anything outside the icon or cannot be scoped. At-rules are
+// not allowed, and nor are escapes, which could hide a reference.
+func (s *iconSanitizer) styleText(text string, ids *iconIDs) string {
+	text = removeCSSComments(text)
+	switch {
+	case strings.Contains(text, `\`):
+		s.strip("style sheet with CSS escapes")
+		return ""
+	case strings.Contains(strings.ToLower(text), "@import"):
+		s.strip("style sheet import")
+		return ""
+	case strings.Contains(text, "@"):
+		s.strip("style sheet at-rule")
+		return ""
+	}
+	if ref := externalReference(text); ref != "" {
+		s.strip("reference " + quoteValue(ref))
+		return ""
+	}
+	return ids.styleSheet(text)
+}
+
+// strip records that the given content has been removed.
+func (s *iconSanitizer) strip(what string) {
+	if s.removed == nil {
+		s.removed = make(map[string]bool)
+	}
+	s.removed[what] = true
+}
+
+// stripped returns descriptions of everything removed, in sorted order.
+func (s *iconSanitizer) stripped() []string {
+	if len(s.removed) == 0 {
+		return nil
+	}
+	stripped := make([]string, 0, len(s.removed))
+	for what := range s.removed {
+		stripped = append(stripped, what)
+	}
+	sort.Strings(stripped)
+	return stripped
+}
+
+// internalHref reports whether the given href on the element with the
+// given name refers to something inside the icon, or to image data held
+// within it. Image data is only allowed for elements that draw an image,
+// as other elements could use it to include another document.
+func internalHref(name xml.Name, href string) bool {
+	href = strings.TrimSpace(href)
+	if strings.HasPrefix(href, "#") {
+		return true
+	}
+	return (name.Local == "image" || name.Local == "feImage") && strings.HasPrefix(strings.ToLower(href), "data:image/")
+}
+
+// removeCSSComments returns the given style sheet or attribute value
+// with its comments removed. As in CSS, an unterminated comment extends
+// to the end.
+func removeCSSComments(css string) string {
+	var buf strings.Builder
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			buf.WriteString(css)
+			return buf.String()
+		}
+		buf.WriteString(css[:start])
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			return buf.String()
+		}
+		// A comment separates the text either side of it.
+		buf.WriteByte(' ')
+		css = css[start+2+end+2:]
+	}
+}
+
+// externalReference returns the first reference in the given attribute
+// value or style sheet to something outside the icon, or the empty
+// string if there is none.  Only references of the form url(#id) are
+// allowed.
+func externalReference(value string) string {
+	lower := strings.ToLower(value)
+	if i := strings.Index(lower, "javascript:"); i >= 0 {
+		return value[i:]
+	}
+	if i := strings.Index(lower, "expression("); i >= 0 {
+		return value[i:]
+	}
+	for {
+		i := strings.Index(lower, "url(")
+		if i < 0 {
+			return ""
+		}
+		value, lower = value[i+len("url("):], lower[i+len("url("):]
+		ref := strings.TrimLeft(value, " \t\n'\"")
+		if !strings.HasPrefix(ref, "#") {
+			if end := strings.IndexAny(ref, ")'\""); end >= 0 {
+				ref = ref[:end]
+			}
+			return ref
+		}
+	}
+}
+
+// xmlName returns the given name in a form suitable for messages.
+func xmlName(name xml.Name) string {
+	if name.Space == "" || name.Space == svgNamespace {
+		return name.Local
+	}
+	return "{" + name.Space + "}" + name.Local
+}
+
+// quoteValue returns the given value quoted, truncating it if it is
+// long.
+func quoteValue(value string) string {
+	if len(value) > 40 {
+		value = value[:37] + "..."
+	}
+	return fmt.Sprintf("%q", value)
+}
+
+// stringSet returns a set holding the given strings.
+func stringSet(ss ...string) map[string]bool {
+	set := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		set[s] = true
+	}
+	return set
+}
+
+// getXMLAttr returns the value of the attribute with the given name, or
+// the empty string if there is none.
+func getXMLAttr(attrs []xml.Attr, name xml.Name) string {
+	for _, attr := range attrs {
+		if attr.Name == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
 // setXMLAttr returns the given attributes with the given attribute name set to
 // val, adding an attribute if necessary.
 func setXMLAttr(attrs []xml.Attr, name xml.Name, val string) []xml.Attr {
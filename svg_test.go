@@ -16,6 +16,7 @@ func TestProcessIcon(t *testing.T) {
 		about    string
 		icon     string
 		expected string
+		stripped []string
 		err      string
 	}{
 		{
@@ -27,7 +28,7 @@ func TestProcessIcon(t *testing.T) {
 				`,
 			expected: `
 				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-0">
-					<g id="foo"></g>
+					<g id="test-0-foo"></g>
 				</svg>`,
 		},
 		{
@@ -43,9 +44,9 @@ func TestProcessIcon(t *testing.T) {
 			expected: `
 				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-1">
 					<svg>
-						<g id="foo"></g>
+						<g id="test-1-foo"></g>
 					</svg>
-					<g id="bar"></g>
+					<g id="test-1-bar"></g>
 				</svg>`,
 		},
 		{
@@ -58,7 +59,7 @@ func TestProcessIcon(t *testing.T) {
 				`,
 			expected: `
 				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-2">
-					<g id="foo"></g>
+					<g id="test-2-foo"></g>
 				</svg>`,
 		},
 		{
@@ -71,7 +72,7 @@ func TestProcessIcon(t *testing.T) {
 				`,
 			expected: `
 				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-3">
-					<g id="foo"></g>
+					<g id="test-3-foo"></g>
 				</svg>`,
 		},
 		{
@@ -84,7 +85,7 @@ func TestProcessIcon(t *testing.T) {
 				`,
 			expected: `
 				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-4">
-					<g id="foo"></g>
+					<g id="test-4-foo"></g>
 				</svg>`,
 		},
 		{
@@ -97,11 +98,11 @@ func TestProcessIcon(t *testing.T) {
 				`,
 			expected: `
 				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-5">
-					<g id="foo"></g>
+					<g id="test-5-foo"></g>
 				</svg>`,
 		},
 		{
-			about: "ProcInsts/Directives inside svg left in place",
+			about: "ProcInsts/Directives inside svg stripped",
 			icon: `
 				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100">
 					<!DOCTYPE svg>
@@ -111,9 +112,175 @@ func TestProcessIcon(t *testing.T) {
 				`,
 			expected: `
 				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-6">
-					<!DOCTYPE svg>
-					<?proc foo="bar"?>
-					<g id="foo"></g>
+					<g id="test-6-foo"></g>
+				</svg>`,
+			stripped: []string{"directive", "processing instruction proc"},
+		},
+		{
+			about: "Scripts and event handlers stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" onload="alert(1)">
+					<script>alert(2)</script>
+					<g id="foo" onclick="alert(3)">
+						<foreignObject><div xmlns="http://www.w3.org/1999/xhtml">bad-wolf</div></foreignObject>
+						<rect width="10" height="10"><set attributeName="fill" to="red"/></rect>
+					</g>
+					<a href="javascript:alert(4)"><circle r="5"/></a>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-7">
+					<g id="test-7-foo">
+						<rect width="10" height="10"></rect>
+					</g>
+				</svg>`,
+			stripped: []string{
+				"attribute onclick",
+				"attribute onload",
+				"element a",
+				"element foreignObject",
+				"element script",
+				"element set",
+			},
+		},
+		{
+			about: "External references stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="100" height="100">
+					<style>@import url(http://example.com/a.css); rect { fill: red }</style>
+					<style>circle { fill: url('https://example.com/b.svg#p') }</style>
+					<style>path { fill: url(#grad) }</style>
+					<image width="10" height="10" xlink:href="http://example.com/c.png"/>
+					<image width="10" height="10" href="data:image/png;base64,AAAA"/>
+					<use xlink:href="#foo" fill="url(#grad)"/>
+					<use href="other.svg#foo"/>
+					<rect width="10" height="10" style="fill: url( 'http://example.com/d' )" filter="url(#f)"/>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns:xlink="http://www.w3.org/1999/xlink" xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-8">
+					<style></style>
+					<style></style>
+					<style>#test-8 path { fill: url(#test-8-grad) }</style>
+					<image width="10" height="10"></image>
+					<image width="10" height="10" href="data:image/png;base64,AAAA"></image>
+					<use xlink:href="#test-8-foo" fill="url(#test-8-grad)"></use>
+					<use></use>
+					<rect width="10" height="10" filter="url(#test-8-f)"></rect>
+				</svg>`,
+			stripped: []string{
+				`reference "http://example.com/c.png"`,
+				`reference "http://example.com/d"`,
+				`reference "https://example.com/b.svg#p"`,
+				`reference "other.svg#foo"`,
+				"style sheet import",
+			},
+		},
+		{
+			about: "Editor metadata stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" inkscape:version="0.48" width="100" height="100">
+					<metadata><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"/></metadata>
+					<inkscape:grid/>
+					<g inkscape:label="Layer 1" xml:space="preserve" data-foo="bar"></g>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-9">
+					<g xml:space="preserve"></g>
+				</svg>`,
+			stripped: []string{
+				"attribute data-foo",
+				"attribute {http://www.inkscape.org/namespaces/inkscape}label",
+				"attribute {http://www.inkscape.org/namespaces/inkscape}version",
+				"element metadata",
+				"element {http://www.inkscape.org/namespaces/inkscape}grid",
+			},
+		},
+		{
+			about: "Ids and references namespaced",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="root">
+					<style>rect { fill: url("#linearGradient1") }</style>
+					<defs>
+						<linearGradient id="linearGradient1"><stop offset="0"/></linearGradient>
+						<linearGradient id="linearGradient2" xlink:href="#linearGradient1"/>
+						<clipPath id="clip"><rect width="10" height="10"/></clipPath>
+						<mask id="mask"><rect width="10" height="10"/></mask>
+					</defs>
+					<rect fill="url(#linearGradient2)" clip-path="url( '#clip' )" mask="url(#mask)" style="stroke:url(#linearGradient1);fill:#fff"/>
+					<use href="#root"/>
+					<use href=" #clip "/>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns:xlink="http://www.w3.org/1999/xlink" xmlns="http://www.w3.org/2000/svg" id="test-10">
+					<style>#test-10 rect { fill: url(&#34;#test-10-linearGradient1&#34;) }</style>
+					<defs>
+						<linearGradient id="test-10-linearGradient1"><stop offset="0"></stop></linearGradient>
+						<linearGradient id="test-10-linearGradient2" xlink:href="#test-10-linearGradient1"></linearGradient>
+						<clipPath id="test-10-clip"><rect width="10" height="10"></rect></clipPath>
+						<mask id="test-10-mask"><rect width="10" height="10"></rect></mask>
+					</defs>
+					<rect fill="url(#test-10-linearGradient2)" clip-path="url( '#test-10-clip' )" mask="url(#test-10-mask)" style="stroke:url(#test-10-linearGradient1);fill:#fff"></rect>
+					<use href="#test-10"></use>
+					<use href="#test-10-clip"></use>
+				</svg>`,
+		},
+		{
+			about: "Hidden references stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100">
+					<style>@imp<!-- x -->ort "http://evil.example/x.css";</style>
+					<style>@\\69mport "http://evil.example/x.css";</style>
+					<style>@media screen { rect { fill: red } }</style>
+					<style>rect { fill: u/**/rl(#a) }<rect/></style>
+					<rect width="10" height="10" style="fill:u\\72l(http://evil.example/)"/>
+					<rect width="10" height="10" style="fill:/* red */blue"/>
+					<use href="data:image/svg+xml,%3Csvg%3E%3C/svg%3E"/>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-11">
+					<style></style>
+					<style></style>
+					<style></style>
+					<style>#test-11 rect { fill: u rl(#a) }</style>
+					<rect width="10" height="10"></rect>
+					<rect width="10" height="10" style="fill: blue"></rect>
+					<use></use>
+				</svg>`,
+			stripped: []string{
+				"attribute style with CSS escapes",
+				"element rect",
+				`reference "data:image/svg+xml,%3Csvg%3E%3C/svg%3E"`,
+				"style sheet at-rule",
+				"style sheet import",
+				"style sheet with CSS escapes",
+			},
+		},
+		{
+			about: "Style sheets scoped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="logo">
+					<style>
+						.st0 { fill: red }
+						rect, circle{fill:blue}
+						text { font-family: "a{b}" }
+						#logo #bg, #logo-2 > rect { fill: url(#grad) }
+						#logo { opacity: 0.5 }
+					</style>
+					<rect id="bg"/>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-12">
+					<style>#test-12 .st0 { fill: red }
+#test-12 rect, #test-12 circle {fill:blue}
+#test-12 text { font-family: &#34;a{b}&#34; }
+#test-12 #test-12-bg, #test-12 #test-12-logo-2 &gt; rect { fill: url(#test-12-grad) }
+#test-12 { opacity: 0.5 }</style>
+					<rect id="test-12-bg"></rect>
 				</svg>`,
 		},
 		{
@@ -131,12 +298,13 @@ func TestProcessIcon(t *testing.T) {
 		c.Run(test.about, func(c *qt.C) {
 			in := bytes.NewBuffer([]byte(test.icon))
 			out := bytes.Buffer{}
-			err := processIcon(in, &out, fmt.Sprintf("test-%d", i))
+			stripped, err := processIcon(in, &out, fmt.Sprintf("test-%d", i), iconOptions{})
 			if test.err != "" {
 				c.Assert(err, qt.ErrorMatches, test.err)
 			} else {
 				c.Assert(err, qt.IsNil)
 				assertXMLEqual(c, out.Bytes(), []byte(test.expected))
+				c.Assert(stripped, qt.DeepEquals, test.stripped)
 			}
 		})
 	}
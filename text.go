@@ -0,0 +1,352 @@
+package jujusvg
+
+import (
+	"bufio"
+	"io"
+	"math"
+
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// defaultTextWidth is the number of columns used by MarshalTerminal
+	// when no width is specified.
+	defaultTextWidth = 80
+
+	// textCellAspect is the ratio of the height of a terminal cell to
+	// its width, used so that diagrams are not stretched vertically.
+	textCellAspect = 2
+
+	ansiReset       = "\x1b[0m"
+	ansiApplication = "\x1b[36m"
+	ansiName        = "\x1b[1m"
+	ansiRelation    = "\x1b[90m"
+)
+
+// TextOptions holds options for rendering a canvas as text.
+type TextOptions struct {
+	// Width holds the number of columns available for the
+	// diagram. If it is not positive, 80 is used.
+	Width int
+
+	// ASCII specifies that only ASCII characters should be used.
+	// By default, Unicode box-drawing characters are used.
+	ASCII bool
+
+	// Color specifies that ANSI escape sequences should be used
+	// to colour applications and relations.
+	Color bool
+}
+
+// Line directions used to build up the character drawn in a cell.
+const (
+	dirUp = 1 << iota
+	dirRight
+	dirDown
+	dirLeft
+)
+
+// boxChars maps combinations of line directions to Unicode box-drawing
+// characters.
+var boxChars = map[int]rune{
+	dirUp:                                '│',
+	dirDown:                              '│',
+	dirUp | dirDown:                      '│',
+	dirLeft:                              '─',
+	dirRight:                             '─',
+	dirLeft | dirRight:                   '─',
+	dirRight | dirDown:                   '┌',
+	dirDown | dirLeft:                    '┐',
+	dirUp | dirRight:                     '└',
+	dirUp | dirLeft:                      '┘',
+	dirUp | dirRight | dirDown:           '├',
+	dirUp | dirDown | dirLeft:            '┤',
+	dirRight | dirDown | dirLeft:         '┬',
+	dirUp | dirRight | dirLeft:           '┴',
+	dirUp | dirRight | dirDown | dirLeft: '┼',
+}
+
+// textCell holds a single character cell of a text diagram.
+type textCell struct {
+	// dirs holds the line directions meeting in the cell, used when
+	// ch is zero.
+	dirs int
+	ch   rune
+	attr string
+}
+
+// textGrid holds a text diagram while it is being drawn.
+type textGrid struct {
+	cells [][]textCell
+	ascii bool
+}
+
+func newTextGrid(width, height int, ascii bool) *textGrid {
+	cells := make([][]textCell, height)
+	for i := range cells {
+		cells[i] = make([]textCell, width)
+	}
+	return &textGrid{
+		cells: cells,
+		ascii: ascii,
+	}
+}
+
+// set draws the given character at the given position, ignoring
+// positions outside the grid.
+func (g *textGrid) set(x, y int, ch rune, attr string) {
+	if y < 0 || y >= len(g.cells) || x < 0 || x >= len(g.cells[y]) {
+		return
+	}
+	g.cells[y][x] = textCell{ch: ch, attr: attr}
+}
+
+// join adds the given line directions to the cell at the given position.
+func (g *textGrid) join(x, y, dirs int, attr string) {
+	if y < 0 || y >= len(g.cells) || x < 0 || x >= len(g.cells[y]) {
+		return
+	}
+	g.cells[y][x].dirs |= dirs
+	g.cells[y][x].attr = attr
+}
+
+// route draws a line from (x0, y0) to (x1, y1), going horizontally
+// first and then vertically.
+func (g *textGrid) route(x0, y0, x1, y1 int, attr string) {
+	for x := x0; x != x1; {
+		if x < x1 {
+			g.join(x, y0, dirRight, attr)
+			x++
+			g.join(x, y0, dirLeft, attr)
+		} else {
+			g.join(x, y0, dirLeft, attr)
+			x--
+			g.join(x, y0, dirRight, attr)
+		}
+	}
+	for y := y0; y != y1; {
+		if y < y1 {
+			g.join(x1, y, dirDown, attr)
+			y++
+			g.join(x1, y, dirUp, attr)
+		} else {
+			g.join(x1, y, dirUp, attr)
+			y--
+			g.join(x1, y, dirDown, attr)
+		}
+	}
+}
+
+// box draws a box with the given label, with its top-left corner at
+// the given position.
+func (g *textGrid) box(x, y int, label string, color bool) {
+	boxAttr, nameAttr := "", ""
+	if color {
+		boxAttr, nameAttr = ansiApplication, ansiApplication+ansiName
+	}
+	width := len([]rune(label)) + 4
+	tl, tr, bl, br, h, v := '┌', '┐', '└', '┘', '─', '│'
+	if g.ascii {
+		tl, tr, bl, br, h, v = '+', '+', '+', '+', '-', '|'
+	}
+	for i := 1; i < width-1; i++ {
+		g.set(x+i, y, h, boxAttr)
+		g.set(x+i, y+2, h, boxAttr)
+		g.set(x+i, y+1, ' ', boxAttr)
+	}
+	g.set(x, y, tl, boxAttr)
+	g.set(x+width-1, y, tr, boxAttr)
+	g.set(x, y+2, bl, boxAttr)
+	g.set(x+width-1, y+2, br, boxAttr)
+	g.set(x, y+1, v, boxAttr)
+	g.set(x+width-1, y+1, v, boxAttr)
+	for i, r := range []rune(label) {
+		g.set(x+2+i, y+1, r, nameAttr)
+	}
+}
+
+// char returns the character to draw for the given cell.
+func (g *textGrid) char(cell textCell) rune {
+	switch {
+	case cell.ch != 0:
+		return cell.ch
+	case cell.dirs == 0:
+		return ' '
+	case !g.ascii:
+		return boxChars[cell.dirs]
+	case cell.dirs&^(dirUp|dirDown) == 0:
+		return '|'
+	case cell.dirs&^(dirLeft|dirRight) == 0:
+		return '-'
+	}
+	return '+'
+}
+
+// write writes the grid to w, omitting trailing blanks on each line.
+func (g *textGrid) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, row := range g.cells {
+		end := len(row)
+		for end > 0 && g.char(row[end-1]) == ' ' {
+			end--
+		}
+		attr := ""
+		for _, cell := range row[:end] {
+			if cell.attr != attr {
+				if attr != "" {
+					bw.WriteString(ansiReset)
+				}
+				bw.WriteString(cell.attr)
+				attr = cell.attr
+			}
+			bw.WriteRune(g.char(cell))
+		}
+		if attr != "" {
+			bw.WriteString(ansiReset)
+		}
+		bw.WriteByte('\n')
+	}
+	if err := bw.Flush(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// MarshalTerminal renders the canvas to the given io.Writer as a text
+// diagram suitable for display in a terminal. Applications are drawn as
+// labelled boxes positioned according to the canvas layout, scaled to
+// fit the width given in opts, and relations are drawn as lines routed
+// between them. The diagram is stretched vertically where boxes would
+// otherwise touch, but is never wider than the given width, so boxes
+// of applications that are very close together may overlap.
+func (c *Canvas) MarshalTerminal(w io.Writer, opts TextOptions) error {
+	if len(c.applications) == 0 {
+		return nil
+	}
+	relationAttr := ""
+	if opts.Color {
+		relationAttr = ansiRelation
+	}
+	layout := c.textLayout(opts.Width)
+	grid := newTextGrid(layout.columns, layout.rows, opts.ASCII)
+
+	// Draw relations first so that application boxes are drawn
+	// on top of them.
+	for _, relation := range c.relations {
+		a, b := layout.boxes[relation.applicationA], layout.boxes[relation.applicationB]
+		grid.route(a.centreX, a.y+1, b.centreX, b.y+1, relationAttr)
+	}
+	for _, application := range c.applications {
+		box := layout.boxes[application]
+		grid.box(box.x, box.y, box.label, opts.Color)
+	}
+	return grid.write(w)
+}
+
+// textLayout holds the positions of the application boxes in a text
+// diagram.
+type textLayout struct {
+	columns, rows int
+	boxes         map[*application]textBox
+}
+
+// textBox holds the position of an application box in a text diagram.
+type textBox struct {
+	label   string
+	x, y    int
+	width   int
+	centreX int
+}
+
+// overlaps reports whether the boxes b and b1 overlap or touch.
+func (b textBox) overlaps(b1 textBox) bool {
+	return b.x <= b1.x+b1.width && b1.x <= b.x+b.width && b.y <= b1.y+3 && b1.y <= b.y+3
+}
+
+// textLayout works out where to draw each application in a text
+// diagram with the given number of columns.
+func (c *Canvas) textLayout(columns int) textLayout {
+	if columns <= 0 {
+		columns = defaultTextWidth
+	}
+	width, height := c.layout()
+
+	// Scale the canvas so that the application centres span the
+	// available columns, leaving room for the widest box at
+	// either side.
+	labels := make(map[*application]string)
+	maxBoxWidth := 0
+	for _, application := range c.applications {
+		label := application.name
+		if r := []rune(label); len(r) > 20 {
+			label = string(r[:17]) + "..."
+		}
+		labels[application] = label
+		if n := len([]rune(label)) + 4; n > maxBoxWidth {
+			maxBoxWidth = n
+		}
+	}
+	spanX := width - applicationBlockSize - 1
+	spanY := height - applicationBlockSize - 1
+	scaleX := 0.0
+	if spanX > 0 {
+		scaleX = math.Max(float64(columns-maxBoxWidth), 0) / float64(spanX)
+	}
+	// Stretch the diagram vertically where needed so that each pair
+	// of applications that is not far enough apart horizontally for
+	// their boxes to be separated by a blank cell is far enough apart
+	// vertically, allowing a cell for rounding. The diagram is never
+	// made taller than it is wide in cells, so boxes that cannot be
+	// separated within that height are left to overlap.
+	maxScaleY := math.Inf(1)
+	if spanY > 0 {
+		maxScaleY = float64(columns*textCellAspect) / float64(spanY)
+	}
+	scaleY := math.Min(scaleX, maxScaleY)
+	for i, a := range c.applications {
+		for _, b := range c.applications[i+1:] {
+			dx := math.Abs(float64(a.point.X - b.point.X))
+			dy := math.Abs(float64(a.point.Y - b.point.Y))
+			gap := float64(len([]rune(labels[a]))+len([]rune(labels[b]))+8)/2 + 2
+			if dx*scaleX >= gap || dy == 0 {
+				continue
+			}
+			if need := 5 * textCellAspect / dy; need <= maxScaleY {
+				scaleY = math.Max(scaleY, need)
+			}
+		}
+	}
+	rows := int(math.Round(float64(spanY)*scaleY/textCellAspect)) + 3
+
+	boxes := make(map[*application]textBox)
+	for _, application := range c.applications {
+		label := labels[application]
+		boxWidth := len([]rune(label)) + 4
+		centreX := maxBoxWidth/2 + int(math.Round(float64(application.point.X)*scaleX))
+		centreY := 1 + int(math.Round(float64(application.point.Y)*scaleY/textCellAspect))
+		boxes[application] = textBox{
+			label:   label,
+			x:       clamp(centreX-boxWidth/2, 0, columns-boxWidth),
+			y:       clamp(centreY-1, 0, rows-3),
+			width:   boxWidth,
+			centreX: centreX,
+		}
+	}
+	return textLayout{
+		columns: columns,
+		rows:    rows,
+		boxes:   boxes,
+	}
+}
+
+// clamp returns x constrained to lie between min and max. If max is less
+// than min, min is returned.
+func clamp(x, min, max int) int {
+	if x > max {
+		x = max
+	}
+	if x < min {
+		x = min
+	}
+	return x
+}
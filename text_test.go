@@ -0,0 +1,166 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charm/v7"
+)
+
+func TestMarshalTerminal(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		about    string
+		opts     TextOptions
+		expected string
+	}{{
+		about: "box drawing",
+		opts:  TextOptions{Width: 60},
+		expected: `
+                                ┌────────────┐
+        ┌───────────────────────│ charmworld │─────┐
+        │                       └────────────┘     │
+        │                                          │
+        │                                          │
+        │                                          │
+        │                                          │
+        │                                          │
+        │                                          │
+        │                                          │
+        │                                          │
+        │                                          │
+┌───────────────┐                                  │
+│ elasticsearch │                             ┌─────────┐
+└───────────────┘                             │ mongodb │
+                                              └─────────┘
+`,
+	}, {
+		about: "ASCII",
+		opts:  TextOptions{Width: 40, ASCII: true},
+		expected: `
+                  +------------+
+        +---------| charmworld |
+        |         +------------+
+        |                      |
+        |                      |
+        |                      |
+        |                      |
++---------------+         +---------+
+| elasticsearch |         | mongodb |
++---------------+         +---------+
+`,
+	}, {
+		about: "colour",
+		opts:  TextOptions{Width: 40, ASCII: true, Color: true},
+		expected: "" +
+			"                  \x1b[36m+------------+\x1b[0m\n" +
+			"        \x1b[90m+---------\x1b[0m\x1b[36m| \x1b[0m\x1b[36m\x1b[1mcharmworld\x1b[0m\x1b[36m |\x1b[0m\n" +
+			"        \x1b[90m|\x1b[0m         \x1b[36m+------------+\x1b[0m\n" +
+			"        \x1b[90m|\x1b[0m                      \x1b[90m|\x1b[0m\n" +
+			"        \x1b[90m|\x1b[0m                      \x1b[90m|\x1b[0m\n" +
+			"        \x1b[90m|\x1b[0m                      \x1b[90m|\x1b[0m\n" +
+			"        \x1b[90m|\x1b[0m                      \x1b[90m|\x1b[0m\n" +
+			"\x1b[36m+---------------+\x1b[0m         \x1b[36m+---------+\x1b[0m\n" +
+			"\x1b[36m| \x1b[0m\x1b[36m\x1b[1melasticsearch\x1b[0m\x1b[36m |\x1b[0m         \x1b[36m| \x1b[0m\x1b[36m\x1b[1mmongodb\x1b[0m\x1b[36m |\x1b[0m\n" +
+			"\x1b[36m+---------------+\x1b[0m         \x1b[36m+---------+\x1b[0m\n",
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			b, err := charm.ReadBundleData(strings.NewReader(bundle))
+			c.Assert(err, qt.IsNil)
+			cvs, err := NewFromBundle(ctx, b, iconURL, new(emptyFetcher))
+			c.Assert(err, qt.IsNil)
+
+			var buf bytes.Buffer
+			err = cvs.MarshalTerminal(&buf, test.opts)
+			c.Assert(err, qt.IsNil)
+			c.Logf("\n%s", buf.String())
+			c.Assert(buf.String(), qt.Equals, strings.TrimPrefix(test.expected, "\n"))
+
+			// No two application boxes touch.
+			layout := cvs.textLayout(test.opts.Width)
+			for i, a := range cvs.applications {
+				for _, b := range cvs.applications[i+1:] {
+					c.Assert(layout.boxes[a].overlaps(layout.boxes[b]), qt.IsFalse, qt.Commentf("%s and %s", a.name, b.name))
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalTerminalEmpty(t *testing.T) {
+	c := qt.New(t)
+
+	var buf bytes.Buffer
+	err := new(Canvas).MarshalTerminal(&buf, TextOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, "")
+}
+
+func TestMarshalTerminalLongName(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b := &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"ωωωωωωωωωωωωωωωωωωωωωω": {
+				Charm: "cs:trusty/wordpress-5",
+			},
+		},
+	}
+	cvs, err := NewFromBundle(ctx, b, iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+	var buf bytes.Buffer
+	err = cvs.MarshalTerminal(&buf, TextOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(utf8.Valid(buf.Bytes()), qt.IsTrue)
+	c.Assert(buf.String(), qt.Contains, "│ ωωωωωωωωωωωωωωωωω... │")
+}
+
+func TestMarshalTerminalCoincident(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b, err := charm.ReadBundleData(strings.NewReader(`
+applications:
+  wordpress:
+    charm: cs:trusty/wordpress-5
+    annotations:
+      gui-x: "0"
+      gui-y: "0"
+  mysql:
+    charm: cs:trusty/mysql-1
+    annotations:
+      gui-x: "1"
+      gui-y: "0"
+  haproxy:
+    charm: cs:trusty/haproxy-2
+    annotations:
+      gui-x: "3000"
+      gui-y: "2000"
+relations:
+  - ["wordpress:db", "mysql:db"]
+`))
+	c.Assert(err, qt.IsNil)
+	cvs, err := NewFromBundle(ctx, b, iconURL, new(emptyFetcher))
+	c.Assert(err, qt.IsNil)
+
+	// Applications that cannot be separated are left to overlap
+	// rather than making the diagram wider than requested.
+	layout := cvs.textLayout(80)
+	c.Assert(layout.columns, qt.Equals, 80)
+	c.Assert(layout.rows <= 80, qt.IsTrue, qt.Commentf("%d rows", layout.rows))
+
+	var buf bytes.Buffer
+	err = cvs.MarshalTerminal(&buf, TextOptions{})
+	c.Assert(err, qt.IsNil)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		c.Assert(utf8.RuneCountInString(line) <= 80, qt.IsTrue, qt.Commentf("%q", line))
+	}
+}